@@ -1,6 +1,12 @@
 package brotli
 
 import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
 	"github.com/andybalholm/brotli"
 	"github.com/gin-gonic/gin"
 )
@@ -11,26 +17,315 @@ const (
 	DefaultCompression = brotli.DefaultCompression
 )
 
+// Brotli returns a middleware compressing responses with the best coding the
+// client accepts, see WithEncodings. level is a brotli level; the other
+// codings use the closest level they support.
 func Brotli(level int, options ...Option) gin.HandlerFunc {
 	return newBrotliHandler(level, options...).Handle
 }
 
+// brotliWriter compresses the response body with the negotiated coding,
+// brotli or otherwise. Whether to compress is decided on the first write,
+// once the handler has set the status and headers, which are held back
+// until then; responses that don't qualify pass through untouched. With a
+// minimum length, the body is buffered until it reaches it, the handler
+// flushes or returns.
 type brotliWriter struct {
-	gin.ResponseWriter
-	writer *brotli.Writer
+	http.ResponseWriter
+	handler  *brotliHandler
+	encoding string // negotiated coding, "" for identity
+
+	status      int // 0 until WriteHeader
+	wroteHeader bool
+	hijacked    bool
+
+	decided   bool
+	buffering bool
+	buf       []byte
+	writer    encoder // nil unless compressing
+
+	// Compressed event streams are flushed after every event.
+	eventStream bool
+	lastByte    byte
+
+	flushed  bool
+	cache    *Cache
+	cacheKey string
+	capture  *captureWriter // copies the compressed body for the cache
+
+	ifNoneMatch string // as sent by the client
+}
+
+// Status returns the status set by the handler, 200 by default.
+func (b *brotliWriter) Status() int {
+	if b.status == 0 {
+		return http.StatusOK
+	}
+	return b.status
+}
+
+func (b *brotliWriter) WriteHeader(code int) {
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		// Informational responses go out as they are.
+		b.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if !b.decided {
+		b.status = code
+	}
+}
+
+// writeHeader sends the status and headers once they are final.
+func (b *brotliWriter) writeHeader() {
+	if b.wroteHeader {
+		return
+	}
+	b.wroteHeader = true
+	b.ResponseWriter.WriteHeader(b.Status())
+}
+
+// writeHeaderNow commits to the status and headers set so far.
+func (b *brotliWriter) writeHeaderNow() {
+	b.decide(nil)
+	if b.buffering {
+		// Headers go out once the body is known.
+		return
+	}
+	b.writeHeader()
 }
 
 func (b *brotliWriter) WriteString(s string) (int, error) {
-	b.Header().Del("Content-Length")
-	return b.writer.Write([]byte(s))
+	return b.Write([]byte(s))
 }
 
 func (b *brotliWriter) Write(data []byte) (int, error) {
-	b.Header().Del("Content-Length")
-	return b.writer.Write(data)
+	b.decide(data)
+
+	if b.buffering {
+		b.buf = append(b.buf, data...)
+		if len(b.buf) < b.handler.MinLength {
+			return len(data), nil
+		}
+		if err := b.startBuffered(); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+
+	if b.writer == nil {
+		b.writeHeader()
+		return b.ResponseWriter.Write(data)
+	}
+
+	n, err := b.writer.Write(data)
+	if err == nil && b.eventStream && b.endsEvent(data) {
+		b.Flush()
+	}
+	return n, err
 }
 
-func (b *brotliWriter) WriteHeader(code int) {
-	b.Header().Del("Content-Length")
-	b.ResponseWriter.WriteHeader(code)
+// ReadFrom lets uncompressed bodies use the underlying io.ReaderFrom, e.g.
+// sendfile for files.
+func (b *brotliWriter) ReadFrom(src io.Reader) (int64, error) {
+	var n int64
+	if !b.decided {
+		// The first bytes may be needed to sniff the Content-Type.
+		var sniff [512]byte
+		nr, err := io.ReadFull(src, sniff[:])
+		if nr > 0 {
+			if _, err := b.Write(sniff[:nr]); err != nil {
+				return 0, err
+			}
+			n = int64(nr)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+
+	if rf, ok := b.ResponseWriter.(io.ReaderFrom); ok && b.writer == nil && !b.buffering {
+		b.writeHeader()
+		nr, err := rf.ReadFrom(src)
+		return n + nr, err
+	}
+	nr, err := io.Copy(writerOnly{b}, src)
+	return n + nr, err
+}
+
+// writerOnly hides ReadFrom from io.Copy.
+type writerOnly struct {
+	io.Writer
+}
+
+// endsEvent reports whether the stream written so far ends with the blank
+// line that terminates a server-sent event.
+func (b *brotliWriter) endsEvent(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	prev := b.lastByte
+	b.lastByte = data[len(data)-1]
+	if len(data) >= 2 {
+		prev = data[len(data)-2]
+	}
+	return prev == '\n' && b.lastByte == '\n'
+}
+
+// Flush sends everything written so far: buffered data starts compression,
+// the encoder emits what it holds and the connection is flushed.
+func (b *brotliWriter) Flush() {
+	b.flushed = true
+	b.decide(nil)
+	if b.buffering {
+		b.startBuffered()
+	}
+	b.writeHeader()
+	if b.writer != nil {
+		b.writer.Flush()
+	}
+	if flusher, ok := b.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (b *brotliWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := b.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		b.hijacked = true
+	}
+	return conn, rw, err
+}
+
+func (b *brotliWriter) Push(target string, opts *http.PushOptions) error {
+	pusher, ok := b.ResponseWriter.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	return pusher.Push(target, opts)
+}
+
+// Unwrap returns the underlying writer for http.ResponseController.
+func (b *brotliWriter) Unwrap() http.ResponseWriter {
+	return b.ResponseWriter
+}
+
+// decide picks passthrough, buffering or compression. data is the first
+// chunk of the body, used to sniff a missing Content-Type.
+func (b *brotliWriter) decide(data []byte) {
+	if b.decided {
+		return
+	}
+	b.decided = true
+
+	header := b.Header()
+	if b.Status() == http.StatusNotModified {
+		b.notModified()
+	}
+	if header.Get("Content-Type") == "" && len(data) > 0 {
+		// Sniff before compressing, net/http would look at compressed bytes.
+		header.Set("Content-Type", http.DetectContentType(data))
+	}
+
+	if !b.handler.shouldCompressResponse(b.Status(), header) {
+		return
+	}
+	addVary(header)
+	if b.encoding == "" {
+		return
+	}
+
+	if minLength := b.handler.MinLength; minLength > 0 {
+		length, err := strconv.Atoi(header.Get("Content-Length"))
+		switch {
+		case err != nil:
+			b.buffering = true
+			return
+		case length < minLength:
+			return
+		}
+	}
+	b.start()
+}
+
+// start commits to compression and sends the headers.
+func (b *brotliWriter) start() {
+	header := b.Header()
+	header.Set("Content-Encoding", b.encoding)
+	header.Del("Content-Length")
+	if etag := header.Get("ETag"); etag != "" {
+		header.Set("ETag", b.handler.ETagMode.compressed(etag, b.encoding))
+	}
+	b.writeHeader()
+
+	var w io.Writer = b.ResponseWriter
+	if b.capture != nil {
+		b.capture.w = b.ResponseWriter
+		w = b.capture
+	}
+	b.writer = getEncoder(b.encoding, b.handler.level, w)
+	b.eventStream = isEventStream(header.Get("Content-Type"))
+}
+
+// notModified gives a 304 the ETag of the compressed representation if
+// that is the one the client has.
+func (b *brotliWriter) notModified() {
+	header := b.Header()
+	etag := header.Get("ETag")
+	if etag == "" || b.encoding == "" {
+		return
+	}
+	if compressed := b.handler.ETagMode.compressed(etag, b.encoding); etagListed(b.ifNoneMatch, compressed) {
+		header.Set("ETag", compressed)
+	}
+}
+
+// startBuffered commits to compression and compresses the buffered data.
+func (b *brotliWriter) startBuffered() error {
+	b.buffering = false
+	b.start()
+	buf := b.buf
+	b.buf = nil
+	_, err := b.writer.Write(buf)
+	return err
+}
+
+// finish completes the response: a body still buffered is too short and
+// goes out as is, a compressed stream is closed and its encoder released,
+// and a status without a body is sent.
+func (b *brotliWriter) finish() {
+	if b.hijacked {
+		return
+	}
+	if !b.decided && b.Status() == http.StatusNotModified {
+		b.decide(nil)
+	}
+	b.decided = true
+
+	if b.buffering {
+		b.buffering = false
+		b.Header().Set("Content-Length", strconv.Itoa(len(b.buf)))
+		b.writeHeader()
+		b.ResponseWriter.Write(b.buf)
+		b.buf = nil
+	}
+
+	if b.writer != nil {
+		b.writer.Close()
+		putEncoder(b.encoding, b.handler.level, b.writer)
+		b.writer = nil
+		if b.cache != nil {
+			b.cache.store(b.cacheKey, b)
+		}
+	}
+
+	if b.status != 0 {
+		b.writeHeader()
+	}
 }
@@ -2,6 +2,9 @@ package brotli
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
 	"fmt"
 	"io"
@@ -10,10 +13,12 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/andybalholm/brotli"
 	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -75,7 +80,7 @@ func TestBrotli(t *testing.T) {
 	assert.Equal(t, w.Header().Get("Vary"), "Accept-Encoding")
 	assert.NotEqual(t, w.Header().Get("Content-Length"), "0")
 	assert.NotEqual(t, w.Body.Len(), 21)
-	assert.Equal(t, fmt.Sprint(w.Body.Len()), w.Header().Get("Content-Length"))
+	assert.Equal(t, "", w.Header().Get("Content-Length"))
 
 	br := brotli.NewReader(w.Body)
 
@@ -90,7 +95,7 @@ func TestBrotliPNG(t *testing.T) {
 	router := gin.New()
 	router.Use(Brotli(DefaultCompression))
 	router.GET("/image.png", func(c *gin.Context) {
-		c.String(200, "this is a PNG!")
+		c.Data(200, "image/png", []byte("this is a PNG!"))
 	})
 
 	w := httptest.NewRecorder()
@@ -102,6 +107,119 @@ func TestBrotliPNG(t *testing.T) {
 	assert.Equal(t, w.Body.String(), "this is a PNG!")
 }
 
+func TestHTMLAtPNGPath(t *testing.T) {
+	req, _ := http.NewRequestWithContext(context.Background(), "GET", "/image.png", nil)
+	req.Header.Add("Accept-Encoding", "br")
+
+	router := gin.New()
+	router.Use(Brotli(DefaultCompression))
+	router.GET("/image.png", func(c *gin.Context) {
+		c.Data(200, "text/html; charset=utf-8", []byte("<p>not a PNG</p>"))
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, "br", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "<p>not a PNG</p>", decodeBody(t, EncodingBrotli, w.Body))
+}
+
+func TestCompressedContentType(t *testing.T) {
+	req, _ := http.NewRequestWithContext(context.Background(), "GET", "/download", nil)
+	req.Header.Add("Accept-Encoding", "br")
+
+	router := gin.New()
+	router.Use(Brotli(DefaultCompression))
+	router.GET("/download", func(c *gin.Context) {
+		c.Data(200, "application/zip", []byte("PK\x03\x04 zip"))
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "PK\x03\x04 zip", w.Body.String())
+}
+
+func TestExistingContentEncoding(t *testing.T) {
+	req, _ := http.NewRequestWithContext(context.Background(), "GET", "/", nil)
+	req.Header.Add("Accept-Encoding", "br, gzip")
+
+	router := gin.New()
+	router.Use(Brotli(DefaultCompression))
+	router.GET("/", func(c *gin.Context) {
+		c.Header("Content-Encoding", "gzip")
+		c.Data(200, "application/json", []byte("already gzipped"))
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "already gzipped", w.Body.String())
+}
+
+func TestSniffedContentType(t *testing.T) {
+	req, _ := http.NewRequestWithContext(context.Background(), "GET", "/", nil)
+	req.Header.Add("Accept-Encoding", "br")
+
+	router := gin.New()
+	router.Use(Brotli(DefaultCompression))
+	router.GET("/", func(c *gin.Context) {
+		c.Writer.Write([]byte("<html><body>sniffed</body></html>"))
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	// The type is sniffed from the plain body, not the compressed one.
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "br", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "<html><body>sniffed</body></html>", decodeBody(t, EncodingBrotli, w.Body))
+}
+
+func TestWithContentTypes(t *testing.T) {
+	router := gin.New()
+	router.Use(Brotli(DefaultCompression,
+		WithContentTypes([]string{"text/*", "application/json"}),
+		WithExcludedContentTypes([]string{"text/csv"})))
+	router.GET("/:type", func(c *gin.Context) {
+		types := map[string]string{
+			"html": "text/html; charset=utf-8",
+			"json": "application/json",
+			"csv":  "text/csv",
+			"xml":  "application/xml",
+		}
+		c.Data(200, types[c.Param("type")], []byte(testResponse))
+	})
+
+	for path, want := range map[string]string{
+		"/html": "br",
+		"/json": "br",
+		"/csv":  "",
+		"/xml":  "",
+	} {
+		req, _ := http.NewRequestWithContext(context.Background(), "GET", path, nil)
+		req.Header.Add("Accept-Encoding", "br")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, want, w.Header().Get("Content-Encoding"), path)
+		assert.Equal(t, testResponse, decodeBody(t, want, w.Body), path)
+	}
+}
+
+func TestContentTypes(t *testing.T) {
+	types := NewContentTypes([]string{"image/*", "Application/JSON"})
+	assert.True(t, types.Contains("image/png"))
+	assert.True(t, types.Contains("application/json; charset=utf-8"))
+	assert.False(t, types.Contains("imagefoo/png"))
+	assert.False(t, types.Contains("text/plain"))
+	assert.False(t, types.Contains(""))
+	assert.True(t, NewContentTypes([]string{"*/*"}).Contains("text/plain"))
+}
+
 func TestExcludedExtensions(t *testing.T) {
 	req, _ := http.NewRequestWithContext(context.Background(), "GET", "/index.html", nil)
 	req.Header.Add("Accept-Encoding", "br")
@@ -166,7 +284,7 @@ func TestBrotliWithReverseProxy(t *testing.T) {
 	assert.Equal(t, w.Header().Get("Vary"), "Accept-Encoding")
 	assert.NotEqual(t, w.Header().Get("Content-Length"), "0")
 	assert.NotEqual(t, w.Body.Len(), 29)
-	assert.Equal(t, fmt.Sprint(w.Body.Len()), w.Header().Get("Content-Length"))
+	assert.Equal(t, "", w.Header().Get("Content-Length"))
 
 	br := brotli.NewReader(w.Body)
 
@@ -253,3 +371,386 @@ func TestDecompressbrotliWithIncorrectData(t *testing.T) {
 
 	assert.Equal(t, http.StatusBadRequest, w.Code)
 }
+
+// serveRequest runs a request through handler and records the response.
+// header lists header names and values in turn.
+func serveRequest(handler http.Handler, method, target string, body []byte, header ...string) *httptest.ResponseRecorder {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, _ := http.NewRequestWithContext(context.Background(), method, target, r)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// encodeBody compresses data with encoding. Besides the content codings,
+// "zlib" gives the zlib-wrapped deflate, deflate itself is raw.
+func encodeBody(t *testing.T, encoding string, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case EncodingBrotli:
+		w = brotli.NewWriter(&buf)
+	case EncodingZstd:
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = zw
+	case EncodingGzip:
+		w = gzip.NewWriter(&buf)
+	case EncodingDeflate:
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "zlib":
+		w = zlib.NewWriter(&buf)
+	default:
+		t.Fatal("unsupported encoding " + encoding)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// decodeBody decompresses body, which is encoded with encoding.
+func decodeBody(t *testing.T, encoding string, body io.Reader) string {
+	var r io.Reader
+	switch encoding {
+	case EncodingBrotli:
+		r = brotli.NewReader(body)
+	case EncodingZstd:
+		zr, err := zstd.NewReader(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	case EncodingGzip:
+		gr, err := gzip.NewReader(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gr
+	case EncodingDeflate:
+		r = flate.NewReader(body)
+	default:
+		r = body
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"br", "br"},
+		{"gzip", "gzip"},
+		{"x-gzip", "gzip"},
+		{"gzip, deflate, br, zstd", "br"},
+		{"gzip, zstd", "zstd"},
+		{"GZIP, Deflate", "gzip"},
+		{"br;q=0.5, gzip;q=0.8", "gzip"},
+		{"br;q=0, gzip", "gzip"},
+		{"br;q=0", ""},
+		{"*", "br"},
+		{"*;q=0.5, br;q=0", "zstd"},
+		{"*;q=0", ""},
+		{"identity", ""},
+		{"identity;q=1, gzip;q=0.5", ""},
+		{"identity;q=0.5, gzip", "gzip"},
+		{"gzip;q=abc, deflate", "deflate"},
+		{"compress, sdch", ""},
+	} {
+		assert.Equal(t, tt.want, negotiateEncoding(tt.header, DefaultEncodings), tt.header)
+	}
+
+	// The server's order breaks ties.
+	assert.Equal(t, "gzip", negotiateEncoding("br, gzip", []string{EncodingGzip, EncodingBrotli}))
+	assert.Equal(t, "", negotiateEncoding("br", []string{EncodingGzip}))
+}
+
+func TestEncodings(t *testing.T) {
+	router := gin.New()
+	router.Use(Brotli(DefaultCompression))
+	router.GET("/", func(c *gin.Context) {
+		c.String(200, testResponse)
+	})
+
+	for _, encoding := range DefaultEncodings {
+		req, _ := http.NewRequestWithContext(context.Background(), "GET", "/", nil)
+		req.Header.Add("Accept-Encoding", encoding)
+
+		// Twice, so pooled encoders are reused.
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, 200, w.Code)
+			assert.Equal(t, encoding, w.Header().Get("Content-Encoding"))
+			assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+			assert.Equal(t, testResponse, decodeBody(t, encoding, w.Body))
+		}
+	}
+}
+
+func TestWithEncodings(t *testing.T) {
+	req, _ := http.NewRequestWithContext(context.Background(), "GET", "/", nil)
+	req.Header.Add("Accept-Encoding", "br, gzip")
+
+	router := gin.New()
+	router.Use(Brotli(BestSpeed, WithEncodings(EncodingGzip)))
+	router.GET("/", func(c *gin.Context) {
+		c.String(200, testResponse)
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, testResponse, decodeBody(t, EncodingGzip, w.Body))
+}
+
+func TestIdentityOnly(t *testing.T) {
+	req, _ := http.NewRequestWithContext(context.Background(), "GET", "/", nil)
+	req.Header.Add("Accept-Encoding", "br;q=0, identity")
+
+	w := httptest.NewRecorder()
+	r := newServer()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.Equal(t, testResponse, w.Body.String())
+}
+
+func TestMinLength(t *testing.T) {
+	router := gin.New()
+	router.Use(Brotli(DefaultCompression, WithMinLength(64)))
+	router.GET("/short", func(c *gin.Context) {
+		c.String(200, testResponse)
+	})
+	router.GET("/long", func(c *gin.Context) {
+		// Several writes that only reach the threshold together.
+		for i := 0; i < 8; i++ {
+			c.Writer.WriteString(testResponse)
+		}
+	})
+	router.GET("/length", func(c *gin.Context) {
+		c.Header("Content-Length", strconv.Itoa(len(testResponse)))
+		c.String(200, testResponse)
+	})
+
+	for path, want := range map[string]string{
+		"/short":  "",
+		"/long":   "br",
+		"/length": "",
+	} {
+		req, _ := http.NewRequestWithContext(context.Background(), "GET", path, nil)
+		req.Header.Add("Accept-Encoding", "br")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code, path)
+		assert.Equal(t, want, w.Header().Get("Content-Encoding"), path)
+		assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"), path)
+		if want == "" {
+			assert.Equal(t, strconv.Itoa(len(testResponse)), w.Header().Get("Content-Length"), path)
+			assert.Equal(t, testResponse, w.Body.String(), path)
+		} else {
+			assert.Equal(t, strings.Repeat(testResponse, 8), decodeBody(t, want, w.Body), path)
+		}
+	}
+}
+
+// decodePrefix decodes the first n bytes of a brotli stream that may still
+// be incomplete.
+func decodePrefix(t *testing.T, body []byte, n int) string {
+	data := make([]byte, n)
+	if _, err := io.ReadFull(brotli.NewReader(bytes.NewReader(body)), data); err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFlush(t *testing.T) {
+	w := newCloseNotifyingRecorder()
+
+	router := gin.New()
+	router.Use(Brotli(DefaultCompression, WithMinLength(1024)))
+	router.GET("/", func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain")
+		c.String(200, testResponse)
+		c.Writer.Flush()
+
+		// Flushing ends buffering: the data is compressed and sent.
+		assert.True(t, w.Flushed)
+		assert.Equal(t, "br", w.Header().Get("Content-Encoding"))
+		assert.Equal(t, testResponse, decodePrefix(t, w.Body.Bytes(), len(testResponse)))
+
+		c.String(200, testReverseResponse)
+	})
+
+	req, _ := http.NewRequestWithContext(context.Background(), "GET", "/", nil)
+	req.Header.Add("Accept-Encoding", "br")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, testResponse+testReverseResponse, decodeBody(t, "br", w.Body))
+}
+
+func TestStream(t *testing.T) {
+	w := newCloseNotifyingRecorder()
+
+	router := gin.New()
+	router.Use(Brotli(DefaultCompression))
+	router.GET("/", func(c *gin.Context) {
+		sent := ""
+		c.Header("Content-Type", "text/plain")
+		c.Stream(func(w io.Writer) bool {
+			io.WriteString(w, testResponse)
+			sent += testResponse
+			return len(sent) < 3*len(testResponse)
+		})
+	})
+
+	req, _ := http.NewRequestWithContext(context.Background(), "GET", "/", nil)
+	req.Header.Add("Accept-Encoding", "br")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, "br", w.Header().Get("Content-Encoding"))
+	assert.True(t, w.Flushed)
+	assert.Equal(t, strings.Repeat(testResponse, 3), decodeBody(t, "br", w.Body))
+}
+
+func TestEventStream(t *testing.T) {
+	event := "event:message\ndata:" + testResponse + "\n\n"
+
+	for _, compress := range []bool{false, true} {
+		w := newCloseNotifyingRecorder()
+
+		router := gin.New()
+		router.Use(Brotli(DefaultCompression, WithEventStream(compress)))
+		router.GET("/", func(c *gin.Context) {
+			for i := 1; i <= 2; i++ {
+				c.SSEvent("message", testResponse)
+				if compress {
+					// Every event is flushed without the handler asking.
+					assert.Equal(t, strings.Repeat(event, i), decodePrefix(t, w.Body.Bytes(), i*len(event)))
+				}
+			}
+		})
+
+		req, _ := http.NewRequestWithContext(context.Background(), "GET", "/", nil)
+		req.Header.Add("Accept-Encoding", "br")
+		req.Header.Add("Accept", "text/event-stream")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+		if compress {
+			assert.Equal(t, "br", w.Header().Get("Content-Encoding"))
+			assert.Equal(t, strings.Repeat(event, 2), decodeBody(t, "br", w.Body))
+		} else {
+			assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+			assert.Equal(t, strings.Repeat(event, 2), w.Body.String())
+		}
+	}
+}
+
+func TestEventStreamContentType(t *testing.T) {
+	router := gin.New()
+	router.Use(Brotli(DefaultCompression))
+	router.GET("/", func(c *gin.Context) {
+		c.SSEvent("message", testResponse)
+	})
+
+	// Without Accept: text/event-stream, the response type still counts.
+	req, _ := http.NewRequestWithContext(context.Background(), "GET", "/", nil)
+	req.Header.Add("Accept-Encoding", "br")
+
+	w := newCloseNotifyingRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "event:message\ndata:"+testResponse+"\n\n", w.Body.String())
+}
+
+func TestBodylessResponses(t *testing.T) {
+	router := gin.New()
+	router.Use(Brotli(DefaultCompression))
+	handler := func(c *gin.Context) {
+		status, _ := strconv.Atoi(c.Query("status"))
+		c.Header("Content-Length", strconv.Itoa(len(testResponse)))
+		c.Data(status, "text/plain", []byte(testResponse))
+	}
+	router.GET("/", handler)
+	router.HEAD("/", handler)
+
+	for _, tt := range []struct {
+		method   string
+		status   int
+		encoding string
+		body     string
+	}{
+		{"GET", 200, "br", testResponse},
+		{"HEAD", 200, "", testResponse},
+		{"GET", 204, "", ""},
+		{"HEAD", 204, "", ""},
+		{"GET", 304, "", ""},
+		{"HEAD", 304, "", ""},
+	} {
+		name := tt.method + " " + strconv.Itoa(tt.status)
+		req, _ := http.NewRequestWithContext(context.Background(), tt.method, "/?status="+strconv.Itoa(tt.status), nil)
+		req.Header.Add("Accept-Encoding", "br")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, tt.status, w.Code, name)
+		assert.Equal(t, tt.encoding, w.Header().Get("Content-Encoding"), name)
+		if tt.encoding == "" {
+			// Left alone, including the length the handler set.
+			assert.Equal(t, strconv.Itoa(len(testResponse)), w.Header().Get("Content-Length"), name)
+			assert.Equal(t, tt.body, w.Body.String(), name)
+		} else {
+			assert.Equal(t, "", w.Header().Get("Content-Length"), name)
+			assert.Equal(t, tt.body, decodeBody(t, tt.encoding, w.Body), name)
+		}
+	}
+}
+
+func TestContentLengthAfterFlush(t *testing.T) {
+	w := newCloseNotifyingRecorder()
+
+	router := gin.New()
+	router.Use(Brotli(DefaultCompression))
+	router.GET("/", func(c *gin.Context) {
+		c.String(200, testResponse)
+		c.Writer.Flush()
+		c.String(200, testResponse)
+	})
+
+	req, _ := http.NewRequestWithContext(context.Background(), "GET", "/", nil)
+	req.Header.Add("Accept-Encoding", "br")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, "br", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "", w.Header().Get("Content-Length"))
+	assert.Equal(t, "", w.Result().Header.Get("Content-Length"))
+	assert.Equal(t, testResponse+testResponse, decodeBody(t, "br", w.Body))
+}
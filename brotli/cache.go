@@ -0,0 +1,258 @@
+package brotli
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache keeps compressed responses in memory so repeated requests skip both
+// the handler and the encoder. Responses are keyed by method, host, path,
+// query, negotiated coding and the request headers listed in Vary, and
+// evicted least recently used first once MaxSize is exceeded.
+//
+// Only complete 200 responses to GET requests are stored, and only if their
+// Cache-Control explicitly allows it: s-maxage or max-age sets the lifetime,
+// public without either stores them for TTL. no-store, no-cache and private
+// responses are never stored, nor are responses without Cache-Control.
+// Responses that set cookies or vary on headers outside Vary are not stored
+// either.
+type Cache struct {
+	// MaxSize bounds the total size of the cached bodies, in bytes.
+	MaxSize int64
+
+	// TTL is the lifetime of public responses without a max-age. Zero only
+	// stores responses with one.
+	TTL time.Duration
+
+	// Vary lists the request headers whose values select different cached
+	// responses. Accept-Encoding is always taken into account.
+	Vary []string
+
+	mu      sync.Mutex
+	lru     list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+	size    int64
+}
+
+type cacheEntry struct {
+	key     string
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// NewCache returns a cache holding up to maxSize bytes of bodies, with
+// responses keyed on the vary request headers.
+func NewCache(maxSize int64, ttl time.Duration, vary ...string) *Cache {
+	return &Cache{
+		MaxSize: maxSize,
+		TTL:     ttl,
+		Vary:    vary,
+	}
+}
+
+// cacheable reports whether a response to req may be looked up and stored.
+func (c *Cache) cacheable(req *http.Request) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" && !c.varies("Authorization") {
+		return false
+	}
+	directives := parseCacheControl(req.Header.Get("Cache-Control"))
+	_, noStore := directives["no-store"]
+	return !noStore
+}
+
+func (c *Cache) varies(name string) bool {
+	for _, vary := range c.Vary {
+		if strings.EqualFold(vary, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Cache) key(req *http.Request, encoding string) string {
+	var key strings.Builder
+	key.WriteString(req.Method)
+	key.WriteByte(0)
+	key.WriteString(req.Host)
+	key.WriteString(req.URL.Path)
+	key.WriteByte('?')
+	key.WriteString(req.URL.RawQuery)
+	key.WriteByte(0)
+	key.WriteString(encoding)
+	for _, vary := range c.Vary {
+		key.WriteByte(0)
+		key.WriteString(strings.Join(req.Header.Values(vary), ","))
+	}
+	return key.String()
+}
+
+// serve writes the cached response for key, reporting whether there was a
+// fresh one. Requests with no-cache skip the cache.
+func (c *Cache) serve(w http.ResponseWriter, r *http.Request, key string) bool {
+	if _, noCache := parseCacheControl(r.Header.Get("Cache-Control"))["no-cache"]; noCache {
+		return false
+	}
+
+	c.mu.Lock()
+	elem, ok := c.entries[key]
+	if ok && time.Now().After(elem.Value.(*cacheEntry).expires) {
+		c.remove(elem)
+		ok = false
+	}
+	if !ok {
+		c.mu.Unlock()
+		return false
+	}
+	c.lru.MoveToFront(elem)
+	entry := elem.Value.(*cacheEntry)
+	c.mu.Unlock()
+
+	header := w.Header()
+	for name, values := range entry.header {
+		header[name] = values
+	}
+
+	etag := entry.header.Get("ETag")
+	if etag != "" && etagMatch(r.Header.Get("If-None-Match"), etag) {
+		header.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+
+	header.Set("Content-Length", strconv.Itoa(len(entry.body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(entry.body)
+	return true
+}
+
+// store keeps the response bw compressed if it is complete and cacheable.
+func (c *Cache) store(key string, bw *brotliWriter) {
+	capture := bw.capture
+	if capture.overflow || bw.flushed || bw.Status() != http.StatusOK {
+		return
+	}
+
+	header := bw.Header()
+	if header.Get("Set-Cookie") != "" {
+		return
+	}
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || !strings.EqualFold(field, "Accept-Encoding") && !c.varies(field) {
+				return
+			}
+		}
+	}
+
+	ttl, ok := c.lifetime(header.Get("Cache-Control"))
+	if !ok {
+		return
+	}
+
+	header = header.Clone()
+	header.Del("Content-Length")
+	c.add(&cacheEntry{
+		key:     key,
+		header:  header,
+		body:    capture.buf,
+		expires: time.Now().Add(ttl),
+	})
+}
+
+// lifetime returns how long a response with cacheControl may be stored.
+func (c *Cache) lifetime(cacheControl string) (time.Duration, bool) {
+	directives := parseCacheControl(cacheControl)
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[directive]; ok {
+			return 0, false
+		}
+	}
+
+	var ttl time.Duration
+	if _, ok := directives["public"]; ok {
+		ttl = c.TTL
+	}
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[directive]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				return 0, false
+			}
+			ttl = time.Duration(seconds) * time.Second
+			break
+		}
+	}
+	return ttl, ttl > 0
+}
+
+func (c *Cache) add(entry *cacheEntry) {
+	size := int64(len(entry.body))
+	if size > c.MaxSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	if elem, ok := c.entries[entry.key]; ok {
+		c.remove(elem)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += size
+	for c.size > c.MaxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *Cache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.body))
+}
+
+// captureWriter copies the compressed body to the cache as it is written to w,
+// giving up past limit bytes.
+type captureWriter struct {
+	w        http.ResponseWriter // nil until compression starts
+	buf      []byte
+	limit    int64
+	overflow bool
+}
+
+func (cw *captureWriter) Write(data []byte) (int, error) {
+	if !cw.overflow {
+		if int64(len(cw.buf)+len(data)) > cw.limit {
+			cw.overflow = true
+			cw.buf = nil
+		} else {
+			cw.buf = append(cw.buf, data...)
+		}
+	}
+	return cw.w.Write(data)
+}
+
+// parseCacheControl returns the directives of a Cache-Control header,
+// lowercased, with their unquoted values.
+func parseCacheControl(header string) map[string]string {
+	directives := make(map[string]string)
+	for _, directive := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if name == "" {
+			continue
+		}
+		directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+	}
+	return directives
+}
@@ -0,0 +1,188 @@
+package brotli
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+var cacheResponse = strings.Repeat(`{"message":"`+testResponse+`"},`, 64)
+
+// newCacheServer counts the calls of its handlers per path. Responses are
+// public unless the cache-control query sets another Cache-Control, or none
+// if empty.
+func newCacheServer(cache *Cache) (*gin.Engine, map[string]int) {
+	calls := make(map[string]int)
+
+	router := gin.New()
+	router.Use(Brotli(BestCompression, WithCache(cache)))
+	router.GET("/*path", func(c *gin.Context) {
+		calls[c.Request.URL.Path]++
+		value, ok := c.GetQuery("cache-control")
+		if !ok {
+			value = "public"
+		}
+		if value != "" {
+			c.Header("Cache-Control", value)
+		}
+		if c.Query("cookie") != "" {
+			c.SetCookie("session", "1", 0, "/", "", false, false)
+		}
+		if value := c.Query("vary"); value != "" {
+			c.Header("Vary", value)
+		}
+		c.Header("ETag", `"v1"`)
+		c.Data(200, "application/json", []byte(cacheResponse+c.Request.URL.Path))
+	})
+	return router, calls
+}
+
+func TestCache(t *testing.T) {
+	router, calls := newCacheServer(NewCache(1<<20, time.Minute))
+
+	first := serveRequest(router, "GET", "/a", nil, "Accept-Encoding", "br")
+	second := serveRequest(router, "GET", "/a", nil, "Accept-Encoding", "br")
+
+	assert.Equal(t, 1, calls["/a"])
+	for _, w := range []*httptest.ResponseRecorder{first, second} {
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "br", w.Header().Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+		assert.Equal(t, `W/"v1"`, w.Header().Get("ETag"))
+	}
+	assert.Equal(t, first.Body.Bytes(), second.Body.Bytes())
+	assert.Equal(t, cacheResponse+"/a", decodeBody(t, "br", second.Body))
+
+	// Each coding and query is a different response.
+	w := serveRequest(router, "GET", "/a", nil, "Accept-Encoding", "gzip")
+	assert.Equal(t, cacheResponse+"/a", decodeBody(t, "gzip", w.Body))
+	serveRequest(router, "GET", "/a?page=2", nil, "Accept-Encoding", "br")
+	assert.Equal(t, 3, calls["/a"])
+
+	// So is each host.
+	serveRequest(router, "GET", "http://other.example/a", nil, "Accept-Encoding", "br")
+	serveRequest(router, "GET", "http://other.example/a", nil, "Accept-Encoding", "br")
+	assert.Equal(t, 4, calls["/a"])
+
+	// Uncompressed responses aren't cached.
+	serveRequest(router, "GET", "/b", nil, "Accept-Encoding", "")
+	serveRequest(router, "GET", "/b", nil, "Accept-Encoding", "")
+	assert.Equal(t, 2, calls["/b"])
+}
+
+func TestCacheVary(t *testing.T) {
+	router, calls := newCacheServer(NewCache(1<<20, time.Minute, "X-Tenant"))
+
+	serveRequest(router, "GET", "/a", nil, "Accept-Encoding", "br", "X-Tenant", "one")
+	serveRequest(router, "GET", "/a", nil, "Accept-Encoding", "br", "X-Tenant", "two")
+	serveRequest(router, "GET", "/a", nil, "Accept-Encoding", "br", "X-Tenant", "one")
+	assert.Equal(t, 2, calls["/a"])
+
+	// Responses varying on other headers can't be told apart.
+	serveRequest(router, "GET", "/b?vary=Cookie", nil, "Accept-Encoding", "br")
+	serveRequest(router, "GET", "/b?vary=Cookie", nil, "Accept-Encoding", "br")
+	assert.Equal(t, 2, calls["/b"])
+
+	serveRequest(router, "GET", "/c?vary=X-Tenant", nil, "Accept-Encoding", "br")
+	serveRequest(router, "GET", "/c?vary=X-Tenant", nil, "Accept-Encoding", "br")
+	assert.Equal(t, 1, calls["/c"])
+
+	// Credentials only share responses if they are part of the key.
+	serveRequest(router, "GET", "/d", nil, "Accept-Encoding", "br", "Authorization", "Bearer token")
+	serveRequest(router, "GET", "/d", nil, "Accept-Encoding", "br", "Authorization", "Bearer token")
+	assert.Equal(t, 2, calls["/d"])
+}
+
+func TestCacheControl(t *testing.T) {
+	router, calls := newCacheServer(NewCache(1<<20, 0))
+
+	for target, want := range map[string]int{
+		"/public":                           2, // no TTL
+		"/max-age?cache-control=max-age=60": 1,
+		"/s-maxage?cache-control=s-maxage=60,max-age=0": 1,
+		"/zero?cache-control=max-age=0":                 2,
+		"/no-store?cache-control=no-store,max-age=60":   2,
+		"/no-cache?cache-control=no-cache,max-age=60":   2,
+		"/private?cache-control=private,max-age=60":     2,
+		"/cookie?cache-control=max-age=60&cookie=1":     2,
+	} {
+		serveRequest(router, "GET", target, nil, "Accept-Encoding", "br")
+		serveRequest(router, "GET", target, nil, "Accept-Encoding", "br")
+		path, _, _ := strings.Cut(target, "?")
+		assert.Equal(t, want, calls[path], target)
+	}
+
+	// Requests can skip the cache.
+	serveRequest(router, "GET", "/max-age?cache-control=max-age=60", nil, "Accept-Encoding", "br", "Cache-Control", "no-cache")
+	assert.Equal(t, 2, calls["/max-age"])
+	serveRequest(router, "GET", "/max-age?cache-control=max-age=60", nil, "Accept-Encoding", "br", "Cache-Control", "no-store")
+	assert.Equal(t, 3, calls["/max-age"])
+
+	// The TTL only applies to responses that allow caching.
+	router, calls = newCacheServer(NewCache(1<<20, time.Minute))
+	for target, want := range map[string]int{
+		"/public":                          1,
+		"/none?cache-control=":             2,
+		"/extension?cache-control=foo=bar": 2,
+	} {
+		serveRequest(router, "GET", target, nil, "Accept-Encoding", "br")
+		serveRequest(router, "GET", target, nil, "Accept-Encoding", "br")
+		path, _, _ := strings.Cut(target, "?")
+		assert.Equal(t, want, calls[path], target)
+	}
+}
+
+func TestCacheExpires(t *testing.T) {
+	router, calls := newCacheServer(NewCache(1<<20, 50*time.Millisecond))
+
+	serveRequest(router, "GET", "/a", nil, "Accept-Encoding", "br")
+	serveRequest(router, "GET", "/a", nil, "Accept-Encoding", "br")
+	time.Sleep(100 * time.Millisecond)
+	serveRequest(router, "GET", "/a", nil, "Accept-Encoding", "br")
+	assert.Equal(t, 2, calls["/a"])
+}
+
+func TestCacheETag(t *testing.T) {
+	router, calls := newCacheServer(NewCache(1<<20, time.Minute))
+
+	serveRequest(router, "GET", "/a", nil, "Accept-Encoding", "br")
+	w := serveRequest(router, "GET", "/a", nil, "Accept-Encoding", "br", "If-None-Match", `W/"v0", "v1"`)
+
+	assert.Equal(t, 1, calls["/a"])
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Equal(t, `W/"v1"`, w.Header().Get("ETag"))
+	assert.Equal(t, 0, w.Body.Len())
+
+	w = serveRequest(router, "GET", "/a", nil, "Accept-Encoding", "br", "If-None-Match", `"v0"`)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, cacheResponse+"/a", decodeBody(t, "br", w.Body))
+}
+
+func TestCacheEviction(t *testing.T) {
+	router, _ := newCacheServer(nil)
+	size := int64(serveRequest(router, "GET", "/a", nil, "Accept-Encoding", "br").Body.Len())
+
+	// Room for two responses.
+	cache := NewCache(2*size+size/2, time.Minute)
+	router, calls := newCacheServer(cache)
+
+	for _, path := range []string{"/a", "/b", "/a", "/c", "/a", "/b"} {
+		serveRequest(router, "GET", path, nil, "Accept-Encoding", "br")
+	}
+	assert.Equal(t, 1, calls["/a"])
+	assert.Equal(t, 2, calls["/b"])
+	assert.Equal(t, 1, calls["/c"])
+	assert.LessOrEqual(t, cache.size, cache.MaxSize)
+
+	// Bodies bigger than the cache are not stored.
+	cache = NewCache(size/2, time.Minute)
+	router, calls = newCacheServer(cache)
+	serveRequest(router, "GET", "/a", nil, "Accept-Encoding", "br")
+	serveRequest(router, "GET", "/a", nil, "Accept-Encoding", "br")
+	assert.Equal(t, 2, calls["/a"])
+}
@@ -0,0 +1,201 @@
+package brotli
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+)
+
+// DecompressLimits bound the request bodies DecompressHandle inflates.
+type DecompressLimits struct {
+	// MaxSize is the largest decompressed body, in bytes. Zero means no limit.
+	MaxSize int64
+
+	// MaxRatio is the largest ratio of decompressed to compressed size.
+	// Bodies decompressing to less than 64 KiB are not held to it, tiny
+	// bodies legitimately compress far beyond it. Zero means no limit.
+	MaxRatio int64
+}
+
+// DefaultDecompressLimits are the limits of DefaultDecompressHandle.
+var DefaultDecompressLimits = DecompressLimits{
+	MaxSize:  32 << 20,
+	MaxRatio: 100,
+}
+
+const (
+	// minRatioCheckSize is the decompressed size from which MaxRatio applies.
+	minRatioCheckSize = 64 << 10
+
+	// zstdMaxWindow is the largest window of the zstd content coding, RFC 8878.
+	zstdMaxWindow = 8 << 20
+)
+
+// decompressEncodings lists the request codings DecompressHandle decodes.
+var decompressEncodings = []string{EncodingBrotli, EncodingZstd, EncodingGzip, EncodingDeflate}
+
+// DefaultDecompressHandle is DecompressHandle with DefaultDecompressLimits.
+func DefaultDecompressHandle(c *gin.Context) {
+	defaultDecompressHandle(c)
+}
+
+var defaultDecompressHandle = DecompressHandle(DefaultDecompressLimits)
+
+// DecompressHandle returns a DecompressFn decoding br, zstd, gzip and
+// deflate request bodies, also when several codings are applied in turn.
+// The body is decoded as the handler reads it, so only the handler's own
+// buffers are held in memory. Reads going past limits fail with an
+// *http.MaxBytesError, like those of http.MaxBytesReader, which handlers
+// should answer with 413. Unknown codings are aborted with 415, coding
+// headers that don't parse with 400.
+func DecompressHandle(limits DecompressLimits) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		req := c.Request
+		if req.Body == nil || req.Body == http.NoBody {
+			return
+		}
+
+		var encodings []string
+		for _, encoding := range strings.Split(req.Header.Get("Content-Encoding"), ",") {
+			encoding = strings.ToLower(strings.TrimSpace(encoding))
+			if encoding == "x-gzip" {
+				encoding = EncodingGzip
+			}
+			if encoding == "" || encoding == EncodingIdentity {
+				continue
+			}
+			if !supportsDecompress(encoding) {
+				c.Header("Accept-Encoding", strings.Join(decompressEncodings, ", "))
+				c.AbortWithStatus(http.StatusUnsupportedMediaType)
+				return
+			}
+			encodings = append(encodings, encoding)
+		}
+		if len(encodings) == 0 {
+			return
+		}
+
+		body, err := newDecompressReader(req.Body, encodings, limits)
+		if err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		req.Header.Del("Content-Encoding")
+		req.Header.Del("Content-Length")
+		req.ContentLength = -1
+		req.Body = body
+	}
+}
+
+func supportsDecompress(encoding string) bool {
+	for _, e := range decompressEncodings {
+		if e == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// decompressReader decodes a request body, to which encodings were applied
+// in order, as it is read.
+type decompressReader struct {
+	r          io.Reader
+	compressed *countingReader
+	body       io.Closer
+	decoders   []io.Closer
+	limits     DecompressLimits
+	n          int64
+	err        error
+}
+
+func newDecompressReader(body io.ReadCloser, encodings []string, limits DecompressLimits) (*decompressReader, error) {
+	d := &decompressReader{compressed: &countingReader{r: body}, body: body, limits: limits}
+	d.r = d.compressed
+	for i := len(encodings) - 1; i >= 0; i-- {
+		decoder, err := newDecoder(encodings[i], d.r)
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+		d.decoders = append(d.decoders, decoder)
+		d.r = decoder
+	}
+	return d, nil
+}
+
+func (d *decompressReader) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+
+	n, err := d.r.Read(p)
+	d.n += int64(n)
+
+	limits := d.limits
+	switch {
+	case limits.MaxSize > 0 && d.n > limits.MaxSize:
+		d.err = &http.MaxBytesError{Limit: limits.MaxSize}
+	case limits.MaxRatio > 0 && d.n >= minRatioCheckSize && d.n > limits.MaxRatio*d.compressed.n:
+		d.err = &http.MaxBytesError{Limit: limits.MaxRatio * d.compressed.n}
+	case errors.Is(err, zstd.ErrWindowSizeExceeded):
+		d.err = &http.MaxBytesError{Limit: zstdMaxWindow}
+	default:
+		return n, err
+	}
+	return 0, d.err
+}
+
+func (d *decompressReader) Close() error {
+	for _, decoder := range d.decoders {
+		decoder.Close()
+	}
+	return d.body.Close()
+}
+
+func newDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case EncodingZstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdMaxWindow))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case EncodingGzip:
+		return gzip.NewReader(r)
+	case EncodingDeflate:
+		// Meant to be zlib, but raw deflate is common too.
+		br := bufio.NewReader(r)
+		if header, err := br.Peek(2); err == nil && isZlibHeader(header) {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	default:
+		return io.NopCloser(brotli.NewReader(r)), nil
+	}
+}
+
+func isZlibHeader(header []byte) bool {
+	return header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,136 @@
+package brotli
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// newDecompressServer echoes the request body it gets, answering bodies
+// past the limits with 413.
+func newDecompressServer(fn func(c *gin.Context), called *bool) *gin.Engine {
+	router := gin.New()
+	router.Use(Brotli(DefaultCompression, WithDecompressFn(fn)))
+	router.POST("/", func(c *gin.Context) {
+		*called = true
+		data, err := c.GetRawData()
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			c.String(http.StatusRequestEntityTooLarge, err.Error())
+			return
+		case err != nil:
+			c.String(400, err.Error())
+			return
+		}
+		c.Header("X-Content-Length", strconv.FormatInt(c.Request.ContentLength, 10))
+		c.Data(200, "text/plain", data)
+	})
+	return router
+}
+
+func TestDecompressEncodings(t *testing.T) {
+	var called bool
+	router := newDecompressServer(DefaultDecompressHandle, &called)
+	data := []byte(strings.Repeat(testResponse, 64))
+
+	for contentEncoding, body := range map[string][]byte{
+		"br":           encodeBody(t, EncodingBrotli, data),
+		"gzip":         encodeBody(t, EncodingGzip, data),
+		"X-Gzip":       encodeBody(t, EncodingGzip, data),
+		"zstd":         encodeBody(t, EncodingZstd, data),
+		"deflate":      encodeBody(t, "zlib", data),
+		" deflate":     encodeBody(t, EncodingDeflate, data), // raw
+		"gzip, br":     encodeBody(t, EncodingBrotli, encodeBody(t, EncodingGzip, data)),
+		"identity, br": encodeBody(t, EncodingBrotli, data),
+	} {
+		w := serveRequest(router, "POST", "/", body, "Content-Encoding", contentEncoding)
+
+		assert.Equal(t, 200, w.Code, contentEncoding)
+		assert.Equal(t, "-1", w.Header().Get("X-Content-Length"), contentEncoding)
+		assert.Equal(t, string(data), w.Body.String(), contentEncoding)
+	}
+}
+
+func TestDecompressUnsupported(t *testing.T) {
+	var called bool
+	router := newDecompressServer(DefaultDecompressHandle, &called)
+
+	w := serveRequest(router, "POST", "/", []byte(testResponse), "Content-Encoding", "compress")
+
+	assert.False(t, called)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	assert.Equal(t, "br, zstd, gzip, deflate", w.Header().Get("Accept-Encoding"))
+
+	w = serveRequest(router, "POST", "/", []byte(testResponse), "Content-Encoding", "gzip")
+	assert.False(t, called)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestDecompressLimits(t *testing.T) {
+	var called bool
+	router := newDecompressServer(DecompressHandle(DecompressLimits{MaxSize: 1 << 20}), &called)
+
+	// A megabyte of zeros takes a few hundred bytes.
+	zeros := make([]byte, 1<<20)
+	for _, encoding := range []string{EncodingBrotli, EncodingGzip, EncodingZstd, EncodingDeflate} {
+		w := serveRequest(router, "POST", "/", encodeBody(t, encoding, append(zeros, 0)), "Content-Encoding", encoding)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code, encoding)
+
+		w = serveRequest(router, "POST", "/", encodeBody(t, encoding, zeros), "Content-Encoding", encoding)
+		assert.Equal(t, 200, w.Code, encoding)
+		assert.Equal(t, len(zeros), w.Body.Len(), encoding)
+	}
+
+	router = newDecompressServer(DecompressHandle(DecompressLimits{MaxRatio: 100}), &called)
+	for _, encoding := range []string{EncodingBrotli, EncodingGzip, EncodingZstd, EncodingDeflate} {
+		w := serveRequest(router, "POST", "/", encodeBody(t, encoding, zeros), "Content-Encoding", encoding)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code, encoding)
+
+		// Small bodies may exceed the ratio.
+		w = serveRequest(router, "POST", "/", encodeBody(t, encoding, zeros[:32<<10]), "Content-Encoding", encoding)
+		assert.Equal(t, 200, w.Code, encoding)
+	}
+}
+
+func TestDecompressStream(t *testing.T) {
+	// The body is decoded as it is read, so handlers reading only the start
+	// of a body past the limits never hit them.
+	var read int
+	router := gin.New()
+	router.Use(Brotli(DefaultCompression, WithDecompressFn(DecompressHandle(DecompressLimits{MaxSize: 1 << 20}))))
+	router.POST("/", func(c *gin.Context) {
+		n, err := io.ReadFull(c.Request.Body, make([]byte, 1<<10))
+		assert.NoError(t, err)
+		read = n
+		c.Status(204)
+	})
+
+	body := encodeBody(t, EncodingGzip, make([]byte, 4<<20))
+	w := serveRequest(router, "POST", "/", body, "Content-Encoding", "gzip")
+	assert.Equal(t, 204, w.Code)
+	assert.Equal(t, 1<<10, read)
+}
+
+func TestHandlerDecompress(t *testing.T) {
+	var called bool
+	handler := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		io.Copy(w, r.Body)
+	}), DefaultCompression, WithDecompressFn(DefaultDecompressHandle))
+
+	w := serveRequest(handler, "POST", "/", encodeBody(t, EncodingZstd, []byte(testResponse)), "Content-Encoding", "zstd")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, testResponse, w.Body.String())
+
+	called = false
+	w = serveRequest(handler, "POST", "/", []byte(testResponse), "Content-Encoding", "compress")
+	assert.False(t, called)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+}
@@ -0,0 +1,174 @@
+package brotli
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content codings supported by the middleware.
+const (
+	EncodingBrotli   = "br"
+	EncodingZstd     = "zstd"
+	EncodingGzip     = "gzip"
+	EncodingDeflate  = "deflate"
+	EncodingIdentity = "identity"
+)
+
+// DefaultEncodings lists the supported codings in the server's order of
+// preference.
+var DefaultEncodings = []string{EncodingBrotli, EncodingZstd, EncodingGzip, EncodingDeflate}
+
+// encoder is implemented by the writers of every supported coding.
+type encoder interface {
+	io.Writer
+	Flush() error
+	Close() error
+	Reset(w io.Writer)
+}
+
+type poolKey struct {
+	encoding string
+	level    int
+}
+
+// encoderPools holds a *sync.Pool of encoders per poolKey.
+var encoderPools sync.Map
+
+// getEncoder returns a pooled encoder writing to w. level is a brotli level,
+// mapped onto the other codings' scales.
+func getEncoder(encoding string, level int, w io.Writer) encoder {
+	key := poolKey{encoding, level}
+	pool, ok := encoderPools.Load(key)
+	if !ok {
+		pool, _ = encoderPools.LoadOrStore(key, &sync.Pool{
+			New: func() interface{} {
+				return newEncoder(encoding, level)
+			},
+		})
+	}
+
+	enc := pool.(*sync.Pool).Get().(encoder)
+	enc.Reset(w)
+	return enc
+}
+
+// putEncoder returns a closed encoder to its pool.
+func putEncoder(encoding string, level int, enc encoder) {
+	enc.Reset(io.Discard)
+	if pool, ok := encoderPools.Load(poolKey{encoding, level}); ok {
+		pool.(*sync.Pool).Put(enc)
+	}
+}
+
+func newEncoder(encoding string, level int) encoder {
+	switch encoding {
+	case EncodingZstd:
+		enc, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderLevel(zstdLevel(level)), zstd.WithEncoderConcurrency(1))
+		return enc
+	case EncodingGzip:
+		enc, _ := gzip.NewWriterLevel(io.Discard, flateLevel(level))
+		return enc
+	case EncodingDeflate:
+		enc, _ := flate.NewWriter(io.Discard, flateLevel(level))
+		return enc
+	default:
+		return brotli.NewWriterLevel(io.Discard, level)
+	}
+}
+
+func flateLevel(level int) int {
+	switch {
+	case level == DefaultCompression:
+		return gzip.DefaultCompression
+	case level <= BestSpeed:
+		return gzip.BestSpeed
+	case level >= BestCompression:
+		return gzip.BestCompression
+	}
+	return 1 + level*(gzip.BestCompression-1)/BestCompression
+}
+
+func zstdLevel(level int) zstd.EncoderLevel {
+	switch {
+	case level <= 2:
+		return zstd.SpeedFastest
+	case level <= DefaultCompression:
+		return zstd.SpeedDefault
+	case level < BestCompression:
+		return zstd.SpeedBetterCompression
+	}
+	return zstd.SpeedBestCompression
+}
+
+// parseAcceptEncoding returns the q-value of every coding in an
+// Accept-Encoding header. Codings are lowercased; entries with an invalid
+// q-value are ignored.
+func parseAcceptEncoding(header string) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, entry := range strings.Split(header, ",") {
+		params := strings.Split(entry, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		if coding == "x-gzip" {
+			coding = EncodingGzip
+		}
+
+		q, valid := 1.0, true
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+			v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || v < 0 || v > 1 {
+				valid = false
+				break
+			}
+			q = v
+		}
+		if valid {
+			accepted[coding] = q
+		}
+	}
+	return accepted
+}
+
+// negotiateEncoding picks the coding with the highest q-value among
+// encodings, preferring earlier ones on ties, with "*" standing in for codings
+// that aren't listed. It returns "" for identity: when the header is empty,
+// nothing is acceptable, or identity is explicitly preferred.
+func negotiateEncoding(header string, encodings []string) string {
+	if header == "" {
+		return ""
+	}
+	accepted := parseAcceptEncoding(header)
+	wildcard, hasWildcard := accepted["*"]
+
+	best, bestQ := "", 0.0
+	for _, encoding := range encodings {
+		q, ok := accepted[encoding]
+		if !ok {
+			if !hasWildcard {
+				continue
+			}
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+
+	if q, ok := accepted[EncodingIdentity]; ok && q > bestQ {
+		return ""
+	}
+	return best
+}
@@ -0,0 +1,72 @@
+package brotli
+
+import "strings"
+
+// ETagMode says how the ETag of a response changes once it is compressed,
+// so that caches don't mistake one representation for the other.
+type ETagMode int
+
+const (
+	// ETagWeaken marks the ETag weak, W/"abc": the compressed body is the
+	// same content but not the same bytes.
+	ETagWeaken ETagMode = iota
+	// ETagSuffix appends the coding to the opaque tag, "abc-br", keeping
+	// it strong.
+	ETagSuffix
+)
+
+// compressed returns the ETag of the representation compressed with encoding.
+func (m ETagMode) compressed(etag, encoding string) string {
+	if m == ETagSuffix {
+		if len(etag) < 2 || !strings.HasSuffix(etag, `"`) {
+			return etag
+		}
+		return etag[:len(etag)-1] + "-" + encoding + `"`
+	}
+	if strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return "W/" + etag
+}
+
+// original adds the ETags the handler gave to the compressed representations
+// listed in an If-None-Match header, so the handler recognizes them.
+func (m ETagMode) original(ifNoneMatch, encoding string) string {
+	if m != ETagSuffix {
+		return ifNoneMatch
+	}
+	suffix := "-" + encoding + `"`
+
+	tags := ifNoneMatch
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if strings.HasSuffix(tag, suffix) {
+			tags += ", " + strings.TrimSuffix(tag, suffix) + `"`
+		}
+	}
+	return tags
+}
+
+// etagListed reports whether etag is one of the tags of an If-None-Match
+// header, as is.
+func etagListed(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimSpace(tag) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// etagMatch reports whether an If-None-Match header matches etag, using the
+// weak comparison.
+func etagMatch(ifNoneMatch, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package brotli
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+var etagResponse = strings.Repeat(testResponse, 16)
+
+// newETagServer serves etagResponse with the ETag "abc", answering
+// conditional and Range requests like http.ServeContent does.
+func newETagServer(options ...Option) *gin.Engine {
+	router := gin.New()
+	router.Use(Brotli(DefaultCompression, options...))
+	router.GET("/", func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain")
+		c.Header("ETag", `"abc"`)
+		http.ServeContent(c.Writer, c.Request, "", time.Time{}, strings.NewReader(etagResponse))
+	})
+	router.GET("/full", func(c *gin.Context) {
+		c.String(200, etagResponse)
+	})
+	return router
+}
+
+func TestETagMode(t *testing.T) {
+	for _, tt := range []struct {
+		mode     ETagMode
+		encoding string
+		etag     string
+	}{
+		{ETagWeaken, "br", `W/"abc"`},
+		{ETagWeaken, "gzip", `W/"abc"`},
+		{ETagWeaken, "", `"abc"`},
+		{ETagSuffix, "br", `"abc-br"`},
+		{ETagSuffix, "gzip", `"abc-gzip"`},
+		{ETagSuffix, "", `"abc"`},
+	} {
+		w := serveRequest(newETagServer(WithETagMode(tt.mode)), "GET", "/", nil, "Accept-Encoding", tt.encoding)
+
+		assert.Equal(t, 200, w.Code, tt.etag)
+		assert.Equal(t, tt.encoding, w.Header().Get("Content-Encoding"), tt.etag)
+		assert.Equal(t, tt.etag, w.Header().Get("ETag"), tt.etag)
+		assert.Equal(t, etagResponse, decodeBody(t, tt.encoding, w.Body), tt.etag)
+	}
+
+	// Weak tags stay as they are.
+	assert.Equal(t, `W/"abc"`, ETagWeaken.compressed(`W/"abc"`, "br"))
+	assert.Equal(t, `W/"abc-br"`, ETagSuffix.compressed(`W/"abc"`, "br"))
+}
+
+func TestETagIfNoneMatch(t *testing.T) {
+	for _, tt := range []struct {
+		mode        ETagMode
+		ifNoneMatch string
+		status      int
+		etag        string
+	}{
+		{ETagWeaken, `W/"abc"`, 304, `W/"abc"`},
+		{ETagWeaken, `"abc"`, 304, `"abc"`},
+		{ETagWeaken, `"other"`, 200, `W/"abc"`},
+		{ETagSuffix, `"abc-br"`, 304, `"abc-br"`},
+		{ETagSuffix, `"other", "abc-br"`, 304, `"abc-br"`},
+		{ETagSuffix, `"abc"`, 304, `"abc"`},
+		{ETagSuffix, `"abc-gzip"`, 200, `"abc-br"`},
+	} {
+		name := tt.ifNoneMatch
+		w := serveRequest(newETagServer(WithETagMode(tt.mode)), "GET", "/", nil, "Accept-Encoding", "br", "If-None-Match", tt.ifNoneMatch)
+
+		assert.Equal(t, tt.status, w.Code, name)
+		assert.Equal(t, tt.etag, w.Header().Get("ETag"), name)
+		if tt.status == 304 {
+			assert.Equal(t, "", w.Header().Get("Content-Encoding"), name)
+			assert.Equal(t, 0, w.Body.Len(), name)
+		} else {
+			assert.Equal(t, "br", w.Header().Get("Content-Encoding"), name)
+			assert.Equal(t, etagResponse, decodeBody(t, "br", w.Body), name)
+		}
+	}
+}
+
+func TestRangeUncompressed(t *testing.T) {
+	router := newETagServer()
+
+	w := serveRequest(router, "GET", "/", nil, "Accept-Encoding", "br", "Range", "bytes=0-9")
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, `"abc"`, w.Header().Get("ETag"))
+	assert.Equal(t, etagResponse[:10], w.Body.String())
+
+	// Handlers ignoring the range answer with the identity body.
+	w = serveRequest(router, "GET", "/full", nil, "Accept-Encoding", "br", "Range", "bytes=0-9")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.Equal(t, etagResponse, w.Body.String())
+}
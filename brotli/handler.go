@@ -1,31 +1,25 @@
 package brotli
 
 import (
-	"fmt"
-	"io"
+	"bufio"
+	"net"
 	"net/http"
 	"path/filepath"
 	"strings"
-	"sync"
 
-	"github.com/andybalholm/brotli"
 	"github.com/gin-gonic/gin"
 )
 
 type brotliHandler struct {
 	*Options
-	brPool sync.Pool
+	level int
 }
 
 func newBrotliHandler(level int, options ...Option) *brotliHandler {
+	opts := *DefaultOptions
 	handler := &brotliHandler{
-		Options: DefaultOptions,
-		brPool: sync.Pool{
-			New: func() interface{} {
-				br := brotli.NewWriterLevel(io.Discard, level)
-				return br
-			},
-		},
+		Options: &opts,
+		level:   level,
 	}
 	for _, setter := range options {
 		setter(handler.Options)
@@ -34,34 +28,89 @@ func newBrotliHandler(level int, options ...Option) *brotliHandler {
 }
 
 func (b *brotliHandler) Handle(c *gin.Context) {
-	if fn := b.DecompressFn; fn != nil && c.Request.Header.Get("Content-Encoding") == "br" {
+	if fn := b.DecompressFn; fn != nil && isEncoded(c.Request) {
 		fn(c)
+		if c.IsAborted() {
+			return
+		}
 	}
+	b.serve(c, c.Next)
+}
+
+// isEncoded reports whether the request body has a Content-Encoding.
+func isEncoded(r *http.Request) bool {
+	ce := strings.TrimSpace(r.Header.Get("Content-Encoding"))
+	return ce != "" && !strings.EqualFold(ce, EncodingIdentity)
+}
 
-	if !b.shouldCompress(c.Request) {
+// serve runs next with the response compressed if the request allows it.
+func (b *brotliHandler) serve(c *gin.Context, next func()) {
+	bw, served := b.wrap(c.Writer, c.Request)
+	if served {
+		c.Abort()
+		return
+	}
+	if bw == nil {
+		next()
 		return
 	}
 
-	br := b.brPool.Get().(*brotli.Writer)
-	defer b.brPool.Put(br)
-	defer br.Reset(io.Discard)
-	br.Reset(c.Writer)
+	c.Writer = &ginWriter{ResponseWriter: c.Writer, bw: bw}
+	// The compressed length is unknown until the encoder is closed, by which
+	// time the headers have been sent: compressed responses go out chunked.
+	defer bw.finish()
+	next()
+}
 
-	c.Header("Content-Encoding", "br")
-	c.Header("Vary", "Accept-Encoding")
-	c.Writer = &brotliWriter{c.Writer, br}
-	defer func() {
-		br.Close()
-		c.Header("Content-Length", fmt.Sprint(c.Writer.Size()))
-	}()
-	c.Next()
+// wrap returns the writer compressing the response to r, or nil if the
+// request rules compression out. served reports that the response was
+// written from cache.
+func (b *brotliHandler) wrap(w http.ResponseWriter, r *http.Request) (bw *brotliWriter, served bool) {
+	if !b.shouldCompress(r) {
+		return nil, false
+	}
+
+	acceptEncoding := r.Header.Get("Accept-Encoding")
+	if acceptEncoding == "" {
+		return nil, false
+	}
+
+	encoding := negotiateEncoding(acceptEncoding, b.Encodings)
+	switch {
+	case r.Method == http.MethodHead:
+		// No body goes out, an encoder would only add its trailer.
+		encoding = ""
+	case r.Header.Get("Range") != "":
+		// Ranges of the identity body can't be served compressed.
+		encoding = ""
+	}
+
+	bw = &brotliWriter{
+		ResponseWriter: w,
+		handler:        b,
+		encoding:       encoding,
+	}
+	if cache := b.Cache; cache != nil && encoding != "" && cache.cacheable(r) {
+		key := cache.key(r, encoding)
+		if cache.serve(w, r, key) {
+			return nil, true
+		}
+		bw.cache, bw.cacheKey = cache, key
+		bw.capture = &captureWriter{limit: cache.MaxSize}
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && encoding != "" {
+		bw.ifNoneMatch = ifNoneMatch
+		r.Header.Set("If-None-Match", b.ETagMode.original(ifNoneMatch, encoding))
+	}
+	return bw, false
 }
 
 func (b *brotliHandler) shouldCompress(req *http.Request) bool {
 
-	if !strings.Contains(req.Header.Get("Accept-Encoding"), "br") ||
-		strings.Contains(req.Header.Get("Connection"), "Upgrade") ||
-		strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+	if strings.Contains(req.Header.Get("Connection"), "Upgrade") {
+		return false
+	}
+	if !b.CompressEventStream && strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
 		return false
 	}
 
@@ -79,3 +128,85 @@ func (b *brotliHandler) shouldCompress(req *http.Request) bool {
 
 	return true
 }
+
+// shouldCompressResponse decides from the response status and headers.
+func (b *brotliHandler) shouldCompressResponse(status int, header http.Header) bool {
+	switch {
+	case status < http.StatusOK,
+		status == http.StatusNoContent,
+		status == http.StatusPartialContent,
+		status == http.StatusNotModified:
+		return false
+	}
+
+	if ce := header.Get("Content-Encoding"); ce != "" && ce != EncodingIdentity {
+		return false
+	}
+
+	contentType := header.Get("Content-Type")
+	if !b.CompressEventStream && isEventStream(contentType) {
+		return false
+	}
+	if len(b.ContentTypes) > 0 && !b.ContentTypes.Contains(contentType) {
+		return false
+	}
+	return !b.ExcludedContentTypes.Contains(contentType)
+}
+
+func isEventStream(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return strings.EqualFold(strings.TrimSpace(mediaType), "text/event-stream")
+}
+
+// addVary adds Accept-Encoding to the Vary header unless it's already there.
+func addVary(header http.Header) {
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	header.Add("Vary", "Accept-Encoding")
+}
+
+// ginWriter presents a brotliWriter to gin handlers. Everything else, such
+// as Size and CloseNotify, comes from gin's writer.
+type ginWriter struct {
+	gin.ResponseWriter
+	bw *brotliWriter
+}
+
+func (g *ginWriter) Write(data []byte) (int, error) {
+	return g.bw.Write(data)
+}
+
+func (g *ginWriter) WriteString(s string) (int, error) {
+	return g.bw.WriteString(s)
+}
+
+func (g *ginWriter) WriteHeader(code int) {
+	// Like gin's writer, ignore the -1 of renders keeping the status.
+	if code > 0 {
+		g.bw.WriteHeader(code)
+	}
+}
+
+func (g *ginWriter) WriteHeaderNow() {
+	g.bw.writeHeaderNow()
+	if g.bw.wroteHeader {
+		g.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (g *ginWriter) Status() int {
+	return g.bw.Status()
+}
+
+func (g *ginWriter) Flush() {
+	g.bw.Flush()
+}
+
+func (g *ginWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return g.bw.Hijack()
+}
@@ -0,0 +1,259 @@
+package brotli
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Handler returns next with its responses compressed like the Brotli
+// middleware does, with the same options. DecompressFn is given a gin
+// context holding just the request and writer.
+//
+// The writer passed to next implements http.Flusher, http.Hijacker,
+// io.ReaderFrom and http.Pusher if the server's writer does.
+func Handler(next http.Handler, level int, options ...Option) http.Handler {
+	b := newBrotliHandler(level, options...)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fn := b.DecompressFn; fn != nil && isEncoded(r) {
+			c := &gin.Context{Request: r, Writer: newContextWriter(w)}
+			fn(c)
+			if c.IsAborted() {
+				return
+			}
+			r = c.Request
+		}
+
+		bw, served := b.wrap(w, r)
+		if served {
+			return
+		}
+		if bw == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		defer bw.finish()
+		next.ServeHTTP(bw.expose(), r)
+	})
+}
+
+// unwrapper is implemented by writers wrapping another, for
+// http.ResponseController.
+type unwrapper interface {
+	Unwrap() http.ResponseWriter
+}
+
+// expose returns b as a writer implementing the same optional interfaces
+// as the one it wraps.
+func (b *brotliWriter) expose() http.ResponseWriter {
+	var mask int
+	if _, ok := b.ResponseWriter.(http.Flusher); ok {
+		mask |= 1
+	}
+	if _, ok := b.ResponseWriter.(http.Hijacker); ok {
+		mask |= 2
+	}
+	if _, ok := b.ResponseWriter.(io.ReaderFrom); ok {
+		mask |= 4
+	}
+	if _, ok := b.ResponseWriter.(http.Pusher); ok {
+		mask |= 8
+	}
+
+	type rw = http.ResponseWriter
+	type u = unwrapper
+	switch mask {
+	case 1:
+		return struct {
+			rw
+			u
+			http.Flusher
+		}{b, b, b}
+	case 2:
+		return struct {
+			rw
+			u
+			http.Hijacker
+		}{b, b, b}
+	case 1 | 2:
+		return struct {
+			rw
+			u
+			http.Flusher
+			http.Hijacker
+		}{b, b, b, b}
+	case 4:
+		return struct {
+			rw
+			u
+			io.ReaderFrom
+		}{b, b, b}
+	case 1 | 4:
+		return struct {
+			rw
+			u
+			http.Flusher
+			io.ReaderFrom
+		}{b, b, b, b}
+	case 2 | 4:
+		return struct {
+			rw
+			u
+			http.Hijacker
+			io.ReaderFrom
+		}{b, b, b, b}
+	case 1 | 2 | 4:
+		return struct {
+			rw
+			u
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{b, b, b, b, b}
+	case 8:
+		return struct {
+			rw
+			u
+			http.Pusher
+		}{b, b, b}
+	case 1 | 8:
+		return struct {
+			rw
+			u
+			http.Flusher
+			http.Pusher
+		}{b, b, b, b}
+	case 2 | 8:
+		return struct {
+			rw
+			u
+			http.Hijacker
+			http.Pusher
+		}{b, b, b, b}
+	case 1 | 2 | 8:
+		return struct {
+			rw
+			u
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{b, b, b, b, b}
+	case 4 | 8:
+		return struct {
+			rw
+			u
+			io.ReaderFrom
+			http.Pusher
+		}{b, b, b, b}
+	case 1 | 4 | 8:
+		return struct {
+			rw
+			u
+			http.Flusher
+			io.ReaderFrom
+			http.Pusher
+		}{b, b, b, b, b}
+	case 2 | 4 | 8:
+		return struct {
+			rw
+			u
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{b, b, b, b, b}
+	case 1 | 2 | 4 | 8:
+		return struct {
+			rw
+			u
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{b, b, b, b, b, b}
+	}
+	return struct {
+		rw
+		u
+	}{b, b}
+}
+
+// contextWriter is the gin.ResponseWriter of the contexts Handler passes to
+// DecompressFn, behaving like gin's own.
+type contextWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func newContextWriter(w http.ResponseWriter) *contextWriter {
+	return &contextWriter{ResponseWriter: w, status: http.StatusOK, size: -1}
+}
+
+func (w *contextWriter) WriteHeader(code int) {
+	if code > 0 && !w.Written() {
+		w.status = code
+	}
+}
+
+func (w *contextWriter) WriteHeaderNow() {
+	if !w.Written() {
+		w.size = 0
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+func (w *contextWriter) Write(data []byte) (int, error) {
+	w.WriteHeaderNow()
+	n, err := w.ResponseWriter.Write(data)
+	w.size += n
+	return n, err
+}
+
+func (w *contextWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *contextWriter) Status() int {
+	return w.status
+}
+
+func (w *contextWriter) Size() int {
+	return w.size
+}
+
+func (w *contextWriter) Written() bool {
+	return w.size != -1
+}
+
+func (w *contextWriter) Flush() {
+	w.WriteHeaderNow()
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *contextWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		w.size = 0
+		return hijacker.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+func (w *contextWriter) CloseNotify() <-chan bool {
+	if notifier, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	return nil
+}
+
+func (w *contextWriter) Pusher() http.Pusher {
+	if pusher, ok := w.ResponseWriter.(http.Pusher); ok {
+		return pusher
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package brotli
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+)
+
+func httpGet(t *testing.T, client *http.Client, url, encoding string) *http.Response {
+	req, _ := http.NewRequestWithContext(context.Background(), "GET", url, nil)
+	req.Header.Set("Accept-Encoding", encoding)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestHandler(t *testing.T) {
+	handler := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"abc"`)
+		io.WriteString(w, etagResponse)
+	}), DefaultCompression, WithEncodings(EncodingGzip), WithETagMode(ETagSuffix))
+
+	for encoding, etag := range map[string]string{
+		"br, gzip": `"abc-gzip"`,
+		"br":       `"abc"`,
+		"":         `"abc"`,
+	} {
+		req, _ := http.NewRequestWithContext(context.Background(), "GET", "/", nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		want := ""
+		if strings.Contains(encoding, "gzip") {
+			want = "gzip"
+		}
+		assert.Equal(t, 200, w.Code, encoding)
+		assert.Equal(t, want, w.Header().Get("Content-Encoding"), encoding)
+		assert.Equal(t, etag, w.Header().Get("ETag"), encoding)
+		assert.Equal(t, etagResponse, decodeBody(t, want, w.Body), encoding)
+	}
+}
+
+func TestHandlerStatus(t *testing.T) {
+	handler := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, etagResponse)
+	}), DefaultCompression)
+
+	req, _ := http.NewRequestWithContext(context.Background(), "GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "br")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "br", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, etagResponse, decodeBody(t, "br", w.Body))
+
+	// A status without a body still goes out.
+	handler = Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}), DefaultCompression)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, 0, w.Body.Len())
+}
+
+// interfacesOf reports the optional interfaces the handler's writer implements.
+func interfacesOf(t *testing.T, server *httptest.Server, client *http.Client) []string {
+	found := make(chan []string, 1)
+	server.Config.Handler = Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var interfaces []string
+		if _, ok := w.(http.Flusher); ok {
+			interfaces = append(interfaces, "Flusher")
+		}
+		if _, ok := w.(http.Hijacker); ok {
+			interfaces = append(interfaces, "Hijacker")
+		}
+		if _, ok := w.(io.ReaderFrom); ok {
+			interfaces = append(interfaces, "ReaderFrom")
+		}
+		if _, ok := w.(http.Pusher); ok {
+			interfaces = append(interfaces, "Pusher")
+		}
+		found <- interfaces
+	}), DefaultCompression)
+
+	resp := httpGet(t, client, server.URL, "br")
+	resp.Body.Close()
+	return <-found
+}
+
+func TestHandlerInterfaces(t *testing.T) {
+	server := httptest.NewServer(nil)
+	defer server.Close()
+	assert.Equal(t, []string{"Flusher", "Hijacker", "ReaderFrom"}, interfacesOf(t, server, server.Client()))
+
+	h2 := httptest.NewUnstartedServer(nil)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+	assert.Equal(t, []string{"Flusher", "Pusher"}, interfacesOf(t, h2, h2.Client()))
+
+	var recorder []string
+	handler := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, flusher := w.(http.Flusher)
+		_, hijacker := w.(http.Hijacker)
+		if flusher {
+			recorder = append(recorder, "Flusher")
+		}
+		if hijacker {
+			recorder = append(recorder, "Hijacker")
+		}
+	}), DefaultCompression)
+	req, _ := http.NewRequestWithContext(context.Background(), "GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "br")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, []string{"Flusher"}, recorder)
+}
+
+func TestHandlerFlush(t *testing.T) {
+	read := make(chan struct{})
+	server := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, testResponse)
+		http.NewResponseController(w).Flush()
+		// The client decodes the first part before the response ends.
+		<-read
+		io.WriteString(w, testReverseResponse)
+	}), DefaultCompression))
+	defer server.Close()
+
+	resp := httpGet(t, server.Client(), server.URL, "br")
+	defer resp.Body.Close()
+	assert.Equal(t, "br", resp.Header.Get("Content-Encoding"))
+
+	br := brotli.NewReader(resp.Body)
+	first := make([]byte, len(testResponse))
+	_, err := io.ReadFull(br, first)
+	close(read)
+	assert.NoError(t, err)
+	assert.Equal(t, testResponse, string(first))
+
+	rest, err := io.ReadAll(br)
+	assert.NoError(t, err)
+	assert.Equal(t, testReverseResponse, string(rest))
+}
+
+func TestHandlerHijack(t *testing.T) {
+	server := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 20\r\nConnection: close\r\n\r\n" + testResponse)
+		rw.Flush()
+	}), DefaultCompression))
+	defer server.Close()
+
+	resp := httpGet(t, server.Client(), server.URL, "br")
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, testResponse, string(body))
+}
+
+func TestHandlerReadFrom(t *testing.T) {
+	server := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/png" {
+			w.Header().Set("Content-Type", "image/png")
+		}
+		// Sniffed from the start of the body if unset.
+		w.(io.ReaderFrom).ReadFrom(strings.NewReader("<html>" + etagResponse))
+	}), DefaultCompression))
+	defer server.Close()
+
+	resp := httpGet(t, server.Client(), server.URL+"/html", "br")
+	assert.Equal(t, "br", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "<html>"+etagResponse, decodeBody(t, "br", resp.Body))
+	resp.Body.Close()
+
+	resp = httpGet(t, server.Client(), server.URL+"/png", "br")
+	assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "<html>"+etagResponse, decodeBody(t, "", resp.Body))
+	resp.Body.Close()
+}
+
+func TestHandlerResponseController(t *testing.T) {
+	server := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		// Reached through Unwrap.
+		assert.NoError(t, rc.SetWriteDeadline(time.Now().Add(time.Minute)))
+		io.WriteString(w, etagResponse)
+		assert.NoError(t, rc.Flush())
+	}), DefaultCompression))
+	defer server.Close()
+
+	resp := httpGet(t, server.Client(), server.URL, "br")
+	defer resp.Body.Close()
+	assert.Equal(t, etagResponse, decodeBody(t, "br", resp.Body))
+}
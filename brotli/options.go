@@ -1,20 +1,27 @@
 package brotli
 
 import (
-	"io"
 	"regexp"
 	"strings"
 
-	"github.com/andybalholm/brotli"
 	"github.com/gin-gonic/gin"
 )
 
 var (
+	// DefaultExcludedExtentions is no longer excluded by default, the
+	// response Content-Type is checked instead.
 	DefaultExcludedExtentions = NewExcludedExtensions([]string{
 		".png", ".gif", ".jpeg", ".jpg",
 	})
+	// DefaultExcludedContentTypes are media types that are already compressed.
+	DefaultExcludedContentTypes = NewContentTypes([]string{
+		"image/*", "video/*", "audio/*", "font/woff", "font/woff2",
+		"application/zip", "application/gzip", "application/x-gzip",
+		"application/zstd", "application/x-7z-compressed", "application/x-rar-compressed",
+	})
 	DefaultOptions = &Options{
-		ExcludedExtensions: DefaultExcludedExtentions,
+		ExcludedContentTypes: DefaultExcludedContentTypes,
+		Encodings:            DefaultEncodings,
 	}
 )
 
@@ -23,6 +30,13 @@ type Options struct {
 	ExcludedPaths        ExcludedPaths
 	ExcludedPathesRegexs ExcludedPathesRegexs
 	DecompressFn         func(c *gin.Context)
+	Encodings            []string
+	ContentTypes         ContentTypes
+	ExcludedContentTypes ContentTypes
+	MinLength            int
+	CompressEventStream  bool
+	Cache                *Cache
+	ETagMode             ETagMode
 }
 
 type Option func(*Options)
@@ -45,6 +59,66 @@ func WithExcludedPathsRegexs(args []string) Option {
 	}
 }
 
+// WithContentTypes only compresses responses whose Content-Type matches one
+// of types, e.g. "text/*" or "application/json".
+func WithContentTypes(types []string) Option {
+	return func(o *Options) {
+		o.ContentTypes = NewContentTypes(types)
+	}
+}
+
+// WithExcludedContentTypes never compresses responses whose Content-Type
+// matches one of types, e.g. "image/*". It replaces DefaultExcludedContentTypes.
+func WithExcludedContentTypes(types []string) Option {
+	return func(o *Options) {
+		o.ExcludedContentTypes = NewContentTypes(types)
+	}
+}
+
+// WithMinLength leaves bodies shorter than n bytes uncompressed, as framing
+// would make them bigger. Bodies without a Content-Length are buffered until
+// they reach n bytes or the handler returns.
+func WithMinLength(n int) Option {
+	return func(o *Options) {
+		o.MinLength = n
+	}
+}
+
+// WithEventStream enables compression of server-sent event streams, which
+// are then flushed after every event. They are left uncompressed by default.
+func WithEventStream(compress bool) Option {
+	return func(o *Options) {
+		o.CompressEventStream = compress
+	}
+}
+
+// WithCache serves repeated responses from cache instead of running the
+// handler and compressing them again.
+func WithCache(cache *Cache) Option {
+	return func(o *Options) {
+		o.Cache = cache
+	}
+}
+
+// WithETagMode sets how the ETags of compressed responses are told apart
+// from the identity ones, ETagWeaken by default.
+func WithETagMode(mode ETagMode) Option {
+	return func(o *Options) {
+		o.ETagMode = mode
+	}
+}
+
+// WithEncodings sets the codings the middleware may use, in the server's
+// order of preference for clients that accept several equally.
+func WithEncodings(encodings ...string) Option {
+	return func(o *Options) {
+		o.Encodings = encodings
+	}
+}
+
+// WithDecompressFn sets the function decoding request bodies with a
+// Content-Encoding, such as DefaultDecompressHandle. Requests it aborts
+// don't reach the handler.
 func WithDecompressFn(decompressFn func(c *gin.Context)) Option {
 	return func(o *Options) {
 		o.DecompressFn = decompressFn
@@ -102,13 +176,33 @@ func (e ExcludedPathesRegexs) Contains(requestURI string) bool {
 	return false
 }
 
-func DefaultDecompressHandle(c *gin.Context) {
-	if c.Request.Body == nil {
-		return
+// ContentTypes is a list of media types. "type/*" matches every subtype
+// and "*/*" everything.
+type ContentTypes []string
+
+func NewContentTypes(types []string) ContentTypes {
+	res := make(ContentTypes, len(types))
+	for i, t := range types {
+		res[i] = strings.ToLower(strings.TrimSpace(t))
 	}
-	brotliReader := brotli.NewReader(c.Request.Body)
+	return res
+}
 
-	c.Request.Header.Del("Content-Encoding")
-	c.Request.Header.Del("Content-Length")
-	c.Request.Body = io.NopCloser(brotliReader)
+// Contains reports whether the media type of a Content-Type header value
+// matches. Parameters such as charset are ignored.
+func (t ContentTypes) Contains(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "" {
+		return false
+	}
+	for _, pattern := range t {
+		switch {
+		case pattern == "*/*", pattern == mediaType:
+			return true
+		case strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, pattern[:len(pattern)-1]):
+			return true
+		}
+	}
+	return false
 }
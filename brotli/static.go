@@ -0,0 +1,168 @@
+package brotli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+
+	"github.com/gin-gonic/gin"
+)
+
+// precompressedExtensions maps codings to the extension of the files
+// holding a precompressed copy, as in foo.js.br next to foo.js.
+var precompressedExtensions = map[string]string{
+	EncodingBrotli: ".br",
+	EncodingZstd:   ".zst",
+	EncodingGzip:   ".gz",
+}
+
+type staticHandler struct {
+	root    http.FileSystem
+	handler *brotliHandler
+}
+
+// Static returns a handler serving files from root. It is meant for a route
+// with a *filepath parameter, like gin's StaticFS, and serves the whole
+// request path otherwise. A directory serves its index.html.
+//
+// If a precompressed sibling of the file exists for a coding the client
+// accepts, it is sent instead with the Content-Type of the original. Other
+// files are compressed on the fly like Brotli does, with the same level and
+// options. Conditional and Range requests apply to the representation sent,
+// each of which has its own ETag.
+func Static(root http.FileSystem, level int, options ...Option) gin.HandlerFunc {
+	s := &staticHandler{
+		root:    root,
+		handler: newBrotliHandler(level, options...),
+	}
+	return s.Handle
+}
+
+// StaticFS is Static for an fs.FS.
+func StaticFS(fsys fs.FS, level int, options ...Option) gin.HandlerFunc {
+	return Static(http.FS(fsys), level, options...)
+}
+
+func (s *staticHandler) Handle(c *gin.Context) {
+	name := c.Param("filepath")
+	if name == "" {
+		name = c.Request.URL.Path
+	}
+	name = path.Clean("/" + name)
+
+	f, info, err := s.open(name)
+	if err == nil && info.IsDir() {
+		f.Close()
+		name = path.Join(name, "index.html")
+		f, info, err = s.open(name)
+	}
+	if err != nil {
+		c.AbortWithStatus(errorStatus(err))
+		return
+	}
+	defer f.Close()
+
+	header := c.Writer.Header()
+	contentType, err := s.contentType(name, f)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	header.Set("Content-Type", contentType)
+
+	if encodings := s.precompressed(name); len(encodings) > 0 {
+		addVary(header)
+		encoding := negotiateEncoding(c.Request.Header.Get("Accept-Encoding"), encodings)
+		if encoding != "" {
+			cf, cinfo, err := s.open(name + precompressedExtensions[encoding])
+			if err == nil {
+				defer cf.Close()
+				header.Set("Content-Encoding", encoding)
+				header.Set("ETag", etag(cinfo, encoding))
+				http.ServeContent(c.Writer, c.Request, name, cinfo.ModTime(), cf)
+				return
+			}
+		}
+	}
+
+	header.Set("ETag", etag(info, ""))
+	s.handler.serve(c, func() {
+		http.ServeContent(c.Writer, c.Request, name, info.ModTime(), f)
+	})
+}
+
+// open opens a regular file or directory and stats it.
+func (s *staticHandler) open(name string) (http.File, fs.FileInfo, error) {
+	f, err := s.root.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+// precompressed lists the enabled codings with a precompressed copy of name,
+// in order of preference.
+func (s *staticHandler) precompressed(name string) []string {
+	var encodings []string
+	for _, encoding := range s.handler.Encodings {
+		ext, ok := precompressedExtensions[encoding]
+		if !ok {
+			continue
+		}
+		f, info, err := s.open(name + ext)
+		if err != nil {
+			continue
+		}
+		f.Close()
+		if !info.IsDir() {
+			encodings = append(encodings, encoding)
+		}
+	}
+	return encodings
+}
+
+// contentType comes from the extension of name, or else is sniffed from the
+// start of f, which is rewound.
+func (s *staticHandler) contentType(name string, f http.File) (string, error) {
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		return contentType, nil
+	}
+
+	var buf [512]byte
+	n, err := io.ReadFull(f, buf[:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// etag is a strong validator from the size and modification time of a file,
+// suffixed with the coding of a precompressed copy.
+func etag(info fs.FileInfo, encoding string) string {
+	if encoding != "" {
+		encoding = "-" + encoding
+	}
+	return fmt.Sprintf(`"%x-%x%s"`, info.ModTime().UnixNano(), info.Size(), encoding)
+}
+
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
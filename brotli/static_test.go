@@ -0,0 +1,142 @@
+package brotli
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func newStaticServer(t *testing.T) (*gin.Engine, fstest.MapFS) {
+	script := []byte(strings.Repeat("console.log('"+testResponse+"');\n", 16))
+	fsys := fstest.MapFS{
+		"app.js":           {Data: script},
+		"app.js.br":        {Data: encodeBody(t, EncodingBrotli, script)},
+		"app.js.gz":        {Data: encodeBody(t, EncodingGzip, script)},
+		"style.css":        {Data: []byte(strings.Repeat("body { margin: 0; }\n", 16))},
+		"noext":            {Data: []byte("<!DOCTYPE html><html></html>")},
+		"docs/index.html":  {Data: []byte("<html>" + testResponse + "</html>")},
+		"docs/readme.html": {Data: []byte(testResponse)},
+	}
+
+	router := gin.New()
+	router.GET("/static/*filepath", StaticFS(fsys, DefaultCompression))
+	return router, fsys
+}
+
+func TestStaticPrecompressed(t *testing.T) {
+	router, fsys := newStaticServer(t)
+
+	for _, tt := range []struct {
+		accept   string
+		encoding string
+		file     string
+	}{
+		{"br, gzip", "br", "app.js.br"},
+		{"gzip", "gzip", "app.js.gz"},
+		{"br;q=0.5, gzip", "gzip", "app.js.gz"},
+		{"", "", "app.js"},
+		{"deflate", "deflate", ""}, // compressed on the fly
+	} {
+		w := serveRequest(router, "GET", "/static/app.js", nil, "Accept-Encoding", tt.accept)
+
+		assert.Equal(t, 200, w.Code, tt.accept)
+		assert.Equal(t, tt.encoding, w.Header().Get("Content-Encoding"), tt.accept)
+		assert.Equal(t, mime.TypeByExtension(".js"), w.Header().Get("Content-Type"), tt.accept)
+		assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"), tt.accept)
+		if tt.encoding == "" {
+			// ServeContent leaves the length out of encoded responses.
+			assert.Equal(t, strconv.Itoa(len(fsys[tt.file].Data)), w.Header().Get("Content-Length"), tt.accept)
+		}
+		if tt.file == "" {
+			assert.Equal(t, string(fsys["app.js"].Data), decodeBody(t, tt.encoding, w.Body), tt.accept)
+		} else {
+			assert.Equal(t, fsys[tt.file].Data, w.Body.Bytes(), tt.accept)
+		}
+	}
+}
+
+func TestStaticETag(t *testing.T) {
+	router, _ := newStaticServer(t)
+
+	etags := make(map[string]string)
+	for _, accept := range []string{"br", "gzip", ""} {
+		w := serveRequest(router, "GET", "/static/app.js", nil, "Accept-Encoding", accept)
+		etag := w.Header().Get("ETag")
+		assert.NotEmpty(t, etag, accept)
+		etags[etag] = accept
+
+		// The validator only matches the representation it came from.
+		w = serveRequest(router, "GET", "/static/app.js", nil, "Accept-Encoding", accept, "If-None-Match", etag)
+		assert.Equal(t, http.StatusNotModified, w.Code, accept)
+		assert.Equal(t, 0, w.Body.Len(), accept)
+	}
+	assert.Len(t, etags, 3)
+}
+
+func TestStaticRange(t *testing.T) {
+	router, fsys := newStaticServer(t)
+
+	w := serveRequest(router, "GET", "/static/app.js", nil, "Accept-Encoding", "br", "Range", "bytes=0-9")
+
+	// Ranges apply to the precompressed representation.
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "br", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, fsys["app.js.br"].Data[:10], w.Body.Bytes())
+
+	w = serveRequest(router, "GET", "/static/style.css", nil, "Accept-Encoding", "br", "Range", "bytes=0-9")
+
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, fsys["style.css"].Data[:10], w.Body.Bytes())
+}
+
+func TestStaticOnTheFly(t *testing.T) {
+	router, fsys := newStaticServer(t)
+
+	w := serveRequest(router, "GET", "/static/style.css", nil, "Accept-Encoding", "br")
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "br", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, mime.TypeByExtension(".css"), w.Header().Get("Content-Type"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.Equal(t, "", w.Header().Get("Content-Length"))
+	assert.Equal(t, string(fsys["style.css"].Data), decodeBody(t, "br", w.Body))
+
+	w = serveRequest(router, "GET", "/static/style.css", nil)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, fsys["style.css"].Data, w.Body.Bytes())
+}
+
+func TestStaticFiles(t *testing.T) {
+	router, fsys := newStaticServer(t)
+
+	for path, want := range map[string]struct {
+		status      int
+		contentType string
+		body        []byte
+	}{
+		"/static/docs/":              {200, mime.TypeByExtension(".html"), fsys["docs/index.html"].Data},
+		"/static/docs":               {200, mime.TypeByExtension(".html"), fsys["docs/index.html"].Data},
+		"/static/docs/readme.html":   {200, mime.TypeByExtension(".html"), fsys["docs/readme.html"].Data},
+		"/static/noext":              {200, "text/html; charset=utf-8", fsys["noext"].Data},
+		"/static/../docs/index.html": {200, mime.TypeByExtension(".html"), fsys["docs/index.html"].Data},
+		"/static/missing.js":         {404, "", nil},
+		"/static/":                   {404, "", nil},
+	} {
+		w := serveRequest(router, "GET", path, nil)
+
+		assert.Equal(t, want.status, w.Code, path)
+		if want.status == 200 {
+			assert.Equal(t, want.contentType, w.Header().Get("Content-Type"), path)
+			assert.Equal(t, want.body, w.Body.Bytes(), path)
+		}
+	}
+}
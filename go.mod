@@ -5,16 +5,15 @@ go 1.20
 require (
 	github.com/andybalholm/brotli v1.0.5
 	github.com/gin-gonic/gin v1.9.0
+	github.com/gorilla/websocket v1.5.0
+	github.com/klauspost/compress v1.17.9
 	github.com/stretchr/testify v1.8.2
+	golang.org/x/crypto v0.5.0
+	golang.org/x/net v0.8.0
 	google.golang.org/grpc v1.54.0
 	google.golang.org/protobuf v1.28.1
 )
 
-require (
-	golang.org/x/crypto v0.5.0 // indirect
-	golang.org/x/net v0.8.0 // indirect
-)
-
 require (
 	github.com/bytedance/sonic v1.8.0 // indirect
 	github.com/chenzhuoyu/base64x v0.0.0-20221115062448-fe3a3abad311 // indirect
@@ -37,8 +36,6 @@ require (
 	github.com/ugorji/go/codec v1.2.9 // indirect
 	github.com/valyala/bytebufferpool v1.0.0
 	golang.org/x/arch v0.0.0-20210923205945-b76863e36670 // indirect
-	golang.org/x/crypto v0.5.0 // indirect
-	golang.org/x/net v0.8.0 // indirect
 	golang.org/x/sys v0.6.0 // indirect
 	golang.org/x/text v0.8.0 // indirect
 	google.golang.org/genproto v0.0.0-20230110181048-76db0878b65f // indirect
@@ -0,0 +1,153 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultCertReloadInterval is how often CertStore checks its files for changes.
+const DefaultCertReloadInterval = time.Minute
+
+var errNoCertificate = errors.New("no certificate configured")
+
+type certEntry struct {
+	certFile string
+	keyFile  string
+	modTime  time.Time
+	cert     *tls.Certificate
+}
+
+// CertStore holds certificate/key pairs loaded from files. Files are reloaded
+// when their modification time changes, and a certificate is selected for each
+// handshake by matching the client's SNI.
+type CertStore struct {
+	// ReloadInterval bounds how often the files are stat'ed.
+	// Zero means DefaultCertReloadInterval.
+	ReloadInterval time.Duration
+
+	mu        sync.RWMutex
+	entries   []*certEntry
+	lastCheck time.Time
+}
+
+// NewCertStore returns a CertStore with a single certificate pair.
+func NewCertStore(certFile, keyFile string) (*CertStore, error) {
+	s := &CertStore{}
+	if err := s.Add(certFile, keyFile); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Add loads a certificate pair into the store. The first pair added is used
+// when no certificate matches the requested server name.
+func (s *CertStore) Add(certFile, keyFile string) error {
+	e := &certEntry{certFile: certFile, keyFile: keyFile}
+	if err := e.load(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.entries = append(s.entries, e)
+	s.lastCheck = time.Now()
+	s.mu.Unlock()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.reloadIfNeeded()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.entries) == 0 {
+		return nil, errNoCertificate
+	}
+
+	for _, e := range s.entries {
+		if hello.SupportsCertificate(e.cert) == nil {
+			return e.cert, nil
+		}
+	}
+
+	return s.entries[0].cert, nil
+}
+
+func (s *CertStore) reloadIfNeeded() {
+	interval := s.ReloadInterval
+	if interval <= 0 {
+		interval = DefaultCertReloadInterval
+	}
+
+	s.mu.RLock()
+	due := time.Since(s.lastCheck) >= interval
+	s.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Another handshake may have reloaded while we waited for the lock.
+	if time.Since(s.lastCheck) < interval {
+		return
+	}
+	s.lastCheck = time.Now()
+
+	for i, e := range s.entries {
+		if !e.changed() {
+			continue
+		}
+		next := &certEntry{certFile: e.certFile, keyFile: e.keyFile}
+		if err := next.load(); err != nil {
+			// Keep serving the old certificate until the new one is valid.
+			log.Println(err)
+			continue
+		}
+		s.entries[i] = next
+	}
+}
+
+func (e *certEntry) changed() bool {
+	modTime, err := latestModTime(e.certFile, e.keyFile)
+	if err != nil {
+		return false
+	}
+	return !modTime.Equal(e.modTime)
+}
+
+func (e *certEntry) load() error {
+	modTime, err := latestModTime(e.certFile, e.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(e.certFile, e.keyFile)
+	if err != nil {
+		return err
+	}
+
+	e.cert = &cert
+	e.modTime = modTime
+	return nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,157 @@
+package tunnel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var certSerial int64
+
+// writeCert writes a self-signed certificate for hosts and its key to
+// dir/name.crt and dir/name.key and returns the serial number.
+func writeCert(tb testing.TB, dir, name string, hosts ...string) int64 {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	certSerial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(certSerial),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0o600); err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0o600); err != nil {
+		tb.Fatal(err)
+	}
+	return certSerial
+}
+
+// startTLS serves certs with a TrojanServer whose handler closes every
+// connection right after the handshake.
+func startTLS(tb testing.TB, certs *CertStore) (string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	srv := &TrojanServer{Certs: certs, Handler: func(net.Conn) {}}
+	go srv.Serve(ln)
+	return ln.Addr().String(), func() { srv.Close() }
+}
+
+// serverSerial returns the serial number of the certificate addr presents
+// for serverName.
+func serverSerial(tb testing.TB, addr, serverName string) int64 {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestCertStoreSNI(t *testing.T) {
+	dir := t.TempDir()
+	a := writeCert(t, dir, "a", "a.example")
+	b := writeCert(t, dir, "b", "b.example", "*.b.example")
+
+	certs, err := NewCertStore(filepath.Join(dir, "a.crt"), filepath.Join(dir, "a.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := certs.Add(filepath.Join(dir, "b.crt"), filepath.Join(dir, "b.key")); err != nil {
+		t.Fatal(err)
+	}
+
+	addr, stop := startTLS(t, certs)
+	defer stop()
+
+	for serverName, want := range map[string]int64{
+		"a.example":     a,
+		"b.example":     b,
+		"www.b.example": b,
+		// Names matching no certificate get the first one.
+		"c.example": a,
+		"":          a,
+	} {
+		if got := serverSerial(t, addr, serverName); got != want {
+			t.Errorf("%q: got certificate %d, want %d", serverName, got, want)
+		}
+	}
+}
+
+func TestCertStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "a.crt"), filepath.Join(dir, "a.key")
+	old := writeCert(t, dir, "a", "a.example")
+
+	certs, err := NewCertStore(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs.ReloadInterval = time.Millisecond
+
+	addr, stop := startTLS(t, certs)
+	defer stop()
+
+	if got := serverSerial(t, addr, "a.example"); got != old {
+		t.Fatalf("got certificate %d, want %d", got, old)
+	}
+
+	// Swap both files; the modification time is moved forward in case the
+	// file system's resolution hides the change.
+	touch := func(at time.Time) {
+		for _, f := range []string{certFile, keyFile} {
+			if err := os.Chtimes(f, at, at); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	renewed := writeCert(t, dir, "a", "a.example")
+	touch(time.Now().Add(time.Hour))
+	time.Sleep(2 * certs.ReloadInterval)
+
+	if got := serverSerial(t, addr, "a.example"); got != renewed {
+		t.Fatalf("after the swap got certificate %d, want %d", got, renewed)
+	}
+
+	// A broken pair is ignored and the last good certificate kept.
+	if err := os.WriteFile(keyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	touch(time.Now().Add(2 * time.Hour))
+	time.Sleep(2 * certs.ReloadInterval)
+
+	if got := serverSerial(t, addr, "a.example"); got != renewed {
+		t.Fatalf("after a broken swap got certificate %d, want %d", got, renewed)
+	}
+}
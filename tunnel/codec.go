@@ -0,0 +1,90 @@
+package tunnel
+
+import (
+	"errors"
+
+	"github.com/Blocked233/middleware/proto"
+
+	"google.golang.org/grpc/encoding"
+	protoCodec "google.golang.org/grpc/encoding/proto"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+/*
+proto.TunByte on the wire, as produced by protobuf:
+
++------+----------------+------+
+| 0x0A | Length(varint) | Data |
++------+----------------+------+
+
+an empty Data is encoded as an empty message.
+*/
+
+const tunByteDataField protowire.Number = 1
+
+var errTunByteWire = errors.New("malformed TunByte message")
+
+// Codec is a gRPC codec that encodes proto.TunByte by hand instead of
+// through protobuf reflection. It is wire compatible with the protobuf codec
+// and uses it for every other message type, so it can serve proto clients.
+//
+// NewGrpcServer installs it. Clients may use it with grpc.ForceCodec.
+type Codec struct{}
+
+// Name returns "proto", the content-subtype it is compatible with.
+func (Codec) Name() string {
+	return protoCodec.Name
+}
+
+// Marshal copies Data once, behind a varint header.
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(*proto.TunByte)
+	if !ok {
+		return encoding.GetCodec(protoCodec.Name).Marshal(v)
+	}
+	if len(m.Data) == 0 {
+		return []byte{}, nil
+	}
+
+	b := make([]byte, 0, 1+protowire.SizeVarint(uint64(len(m.Data)))+len(m.Data))
+	b = protowire.AppendTag(b, tunByteDataField, protowire.BytesType)
+	b = protowire.AppendBytes(b, m.Data)
+	return b, nil
+}
+
+// Unmarshal points Data into data without copying. gRPC hands every
+// received message its own buffer, so data is not reused afterwards.
+// Unknown fields are skipped.
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(*proto.TunByte)
+	if !ok {
+		return encoding.GetCodec(protoCodec.Name).Unmarshal(data, v)
+	}
+
+	m.Data = nil
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return errTunByteWire
+		}
+		data = data[n:]
+
+		if num == tunByteDataField && typ == protowire.BytesType {
+			value, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return errTunByteWire
+			}
+			// Like protobuf, the last occurrence wins.
+			m.Data = value
+			data = data[n:]
+			continue
+		}
+
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		if n < 0 {
+			return errTunByteWire
+		}
+		data = data[n:]
+	}
+	return nil
+}
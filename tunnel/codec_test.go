@@ -0,0 +1,105 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/Blocked233/middleware/proto"
+
+	"google.golang.org/grpc/encoding"
+	protoCodec "google.golang.org/grpc/encoding/proto"
+	"google.golang.org/protobuf/encoding/protowire"
+	pb "google.golang.org/protobuf/proto"
+)
+
+func TestCodecWireCompatible(t *testing.T) {
+	for _, size := range []int{0, 1, 127, 128, 16383, 16384, largeBufferSize + 1} {
+		data := bytes.Repeat([]byte{'x'}, size)
+		msg := &proto.TunByte{Data: data}
+
+		raw, err := Codec{}.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := pb.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(raw, want) {
+			t.Fatalf("size %d: Marshal differs from protobuf", size)
+		}
+
+		var got proto.TunByte
+		if err := (Codec{}).Unmarshal(want, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Data, data) {
+			t.Fatalf("size %d: Unmarshal got %d bytes", size, len(got.Data))
+		}
+	}
+}
+
+func TestCodecUnmarshal(t *testing.T) {
+	// Unknown fields are skipped and the last Data wins, as in protobuf.
+	var b []byte
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, 300)
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendBytes(b, []byte("first"))
+	b = protowire.AppendTag(b, 3, protowire.Fixed32Type)
+	b = protowire.AppendFixed32(b, 7)
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendBytes(b, []byte("last"))
+
+	msg := &proto.TunByte{Data: []byte("stale")}
+	if err := (Codec{}).Unmarshal(b, msg); err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Data) != "last" {
+		t.Fatalf("Data = %q", msg.Data)
+	}
+
+	if err := (Codec{}).Unmarshal(nil, msg); err != nil || msg.Data != nil {
+		t.Fatalf("empty message: %q, %v", msg.Data, err)
+	}
+
+	for _, bad := range [][]byte{
+		{0x0a},
+		{0x0a, 0x05, 'a'},
+		{0x0a, 0xff},
+	} {
+		if err := (Codec{}).Unmarshal(bad, msg); err == nil {
+			t.Fatalf("%x: expected an error", bad)
+		}
+	}
+}
+
+func benchmarkCodec(b *testing.B, codec encoding.Codec) {
+	for _, size := range []int{smallBufferSize, mediumBufferSize, largeBufferSize} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			msg := &proto.TunByte{Data: make([]byte, size)}
+			var out proto.TunByte
+
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				data, err := codec.Marshal(msg)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := codec.Unmarshal(data, &out); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCodecProto(b *testing.B) {
+	benchmarkCodec(b, encoding.GetCodec(protoCodec.Name))
+}
+
+func BenchmarkCodecRaw(b *testing.B) {
+	benchmarkCodec(b, Codec{})
+}
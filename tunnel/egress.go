@@ -0,0 +1,154 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrNotAllowed is returned when the egress policy rejects a destination.
+var ErrNotAllowed = errors.New("destination not allowed")
+
+// DefaultEgress is used by all handlers to reach destinations.
+var DefaultEgress = &Egress{
+	Dialer: net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second},
+}
+
+// Egress dials outbound connections on behalf of clients.
+type Egress struct {
+	Dialer net.Dialer
+
+	// Allow reports whether a client may reach addr over network ("tcp" or "udp").
+	// Nil allows every destination.
+	Allow func(network string, addr Addr) bool
+
+	// NATMode selects which sources may reply to UDP clients. FullCone by default.
+	NATMode NATMode
+
+	// UDPMappingTimeout expires idle UDP destination mappings.
+	// Zero means DefaultUDPMappingTimeout.
+	UDPMappingTimeout time.Duration
+
+	// UDPIdleTimeout closes UDP sessions without traffic in either direction.
+	// Zero means DefaultUDPIdleTimeout.
+	UDPIdleTimeout time.Duration
+
+	// MaxUDPSessionsPerUser limits concurrent UDP sessions per user.
+	// Zero means no limit.
+	MaxUDPSessionsPerUser int
+
+	udpMu       sync.Mutex
+	udpSessions map[string]int
+}
+
+// Dial connects to addr after checking the egress policy.
+func (e *Egress) Dial(network string, addr Addr) (net.Conn, error) {
+	return e.DialContext(context.Background(), network, addr.String())
+}
+
+// DialContext has the signature of net.Dialer.DialContext so it can back an
+// http.Transport. Names are checked again once resolved, so they can't lead
+// to addresses the policy denies; the error then wraps ErrNotAllowed.
+func (e *Egress) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if !e.allowed(network, ParseAddr(address)) {
+		return nil, ErrNotAllowed
+	}
+	if e.Allow == nil {
+		return e.Dialer.DialContext(ctx, network, address)
+	}
+
+	dialer := e.Dialer
+	if control := dialer.ControlContext; control != nil {
+		dialer.ControlContext = func(ctx context.Context, network, address string, c syscall.RawConn) error {
+			if !e.allowed(network, ParseAddr(address)) {
+				return ErrNotAllowed
+			}
+			return control(ctx, network, address, c)
+		}
+	} else {
+		control := dialer.Control
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			if !e.allowed(network, ParseAddr(address)) {
+				return ErrNotAllowed
+			}
+			if control != nil {
+				return control(network, address, c)
+			}
+			return nil
+		}
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// ListenUDP opens an unconnected UDP socket for relaying.
+func (e *Egress) ListenUDP() (*net.UDPConn, error) {
+	return net.ListenUDP("udp", nil)
+}
+
+// listenUDPSession opens a UDP session for user. The session must be closed
+// to release the user's slot.
+func (e *Egress) listenUDPSession(user string) (*udpSession, error) {
+	if !e.acquireUDP(user) {
+		return nil, ErrTooManyUDPSessions
+	}
+
+	conn, err := e.ListenUDP()
+	if err != nil {
+		e.releaseUDP(user)
+		return nil, err
+	}
+
+	session := newUDPSession(conn, e.NATMode, e.UDPMappingTimeout, e.UDPIdleTimeout)
+	session.release = func() { e.releaseUDP(user) }
+	if e.Allow != nil {
+		session.allow = e.AllowUDP
+	}
+	return session, nil
+}
+
+func (e *Egress) acquireUDP(user string) bool {
+	e.udpMu.Lock()
+	defer e.udpMu.Unlock()
+
+	if e.MaxUDPSessionsPerUser > 0 && e.udpSessions[user] >= e.MaxUDPSessionsPerUser {
+		return false
+	}
+	if e.udpSessions == nil {
+		e.udpSessions = make(map[string]int)
+	}
+	e.udpSessions[user]++
+	return true
+}
+
+func (e *Egress) releaseUDP(user string) {
+	e.udpMu.Lock()
+	defer e.udpMu.Unlock()
+
+	if e.udpSessions[user]--; e.udpSessions[user] <= 0 {
+		delete(e.udpSessions, user)
+	}
+}
+
+// AllowUDP checks the policy for a UDP destination.
+func (e *Egress) AllowUDP(addr Addr) bool {
+	return e.allowed("udp", addr)
+}
+
+func (e *Egress) allowed(network string, addr Addr) bool {
+	if e.Allow == nil {
+		return true
+	}
+	if addr == nil {
+		return false
+	}
+	switch network {
+	case "tcp4", "tcp6":
+		network = "tcp"
+	case "udp4", "udp6":
+		network = "udp"
+	}
+	return e.Allow(network, addr)
+}
@@ -0,0 +1,161 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// denyLoopbackIPs allows names but no loopback addresses.
+func denyLoopbackIPs(network string, addr Addr) bool {
+	host, _, _ := net.SplitHostPort(addr.String())
+	ip, err := netip.ParseAddr(host)
+	return err != nil || !ip.IsLoopback()
+}
+
+func TestEgressResolvedAddress(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	port := echo.Addr().(*net.TCPAddr).Port
+
+	e := &Egress{Allow: denyLoopbackIPs}
+
+	// The name passes the first check, its address the second one.
+	for _, target := range []string{echo.Addr().String(), net.JoinHostPort("localhost", strconv.Itoa(port))} {
+		if conn, err := e.Dial("tcp", ParseAddr(target)); !errors.Is(err, ErrNotAllowed) {
+			if conn != nil {
+				conn.Close()
+			}
+			t.Errorf("%s: %v", target, err)
+		}
+	}
+
+	// The dialer's own Control still runs for allowed addresses.
+	controlled := false
+	e = &Egress{Allow: func(string, Addr) bool { return true }}
+	e.Dialer.Control = func(network, address string, c syscall.RawConn) error {
+		controlled = true
+		return nil
+	}
+	conn, err := e.Dial("tcp", ParseAddr(net.JoinHostPort("localhost", strconv.Itoa(port))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if !controlled {
+		t.Fatal("Control not called")
+	}
+}
+
+func TestEgressResolvedUDPAddress(t *testing.T) {
+	peer := udpPeer(t, net.IPv4(127, 0, 0, 1))
+	port := peer.LocalAddr().(*net.UDPAddr).Port
+
+	e := &Egress{Allow: denyLoopbackIPs}
+	session, err := e.listenUDPSession("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	if err := session.WriteTo([]byte("denied"), ParseAddr(net.JoinHostPort("localhost", strconv.Itoa(port)))); err != nil {
+		t.Fatal(err)
+	}
+	if len(session.byClient) != 0 {
+		t.Fatal("denied destination mapped")
+	}
+
+	peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := peer.ReadFrom(make([]byte, 16)); err == nil {
+		t.Fatalf("denied destination got %d bytes", n)
+	}
+}
+
+func TestEgressUDPSessionLimit(t *testing.T) {
+	e := &Egress{MaxUDPSessionsPerUser: 2}
+
+	var sessions []*udpSession
+	for i := 0; i < 2; i++ {
+		session, err := e.listenUDPSession("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, session)
+	}
+	if _, err := e.listenUDPSession("alice"); err != ErrTooManyUDPSessions {
+		t.Fatalf("third session: %v", err)
+	}
+
+	// Other users have their own slots.
+	other, err := e.listenUDPSession("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Close()
+
+	// Closing twice releases the slot once.
+	sessions[0].Close()
+	sessions[0].Close()
+	session, err := e.listenUDPSession("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.listenUDPSession("alice"); err != ErrTooManyUDPSessions {
+		t.Fatalf("session past the limit: %v", err)
+	}
+	session.Close()
+	sessions[1].Close()
+
+	if len(e.udpSessions) != 0 {
+		t.Fatalf("slots left: %v", e.udpSessions)
+	}
+}
+
+func TestEgressUDPIdleTeardown(t *testing.T) {
+	echo := udpEchoServer(t)
+	defer echo.Close()
+
+	e := &Egress{MaxUDPSessionsPerUser: 1}
+	srv, err := NewShadowsocksServer("", "chacha20-ietf-poly1305", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Egress = e
+	srv.UDPIdleTimeout = 100 * time.Millisecond
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServePacket(pc)
+	defer srv.Close()
+
+	c := newTestSSCipher(t, "chacha20-ietf-poly1305")
+	if got := ssExchange(t, c, net.IPv4(127, 0, 0, 1), pc.LocalAddr(), echo.LocalAddr(), "first", 5*time.Second); string(got) != "first" {
+		t.Fatalf("got %q", got)
+	}
+
+	// The idle association is torn down and its slot released...
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		e.udpMu.Lock()
+		open := len(e.udpSessions)
+		e.udpMu.Unlock()
+		if open == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("idle session not torn down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// ...so the client can open another one.
+	if got := ssExchange(t, c, net.IPv4(127, 0, 0, 1), pc.LocalAddr(), echo.LocalAddr(), "second", 5*time.Second); string(got) != "second" {
+		t.Fatalf("got %q", got)
+	}
+}
@@ -0,0 +1,281 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Strategy selects the outbound of a group for each connection.
+type Strategy int
+
+const (
+	// Failover uses the first healthy outbound in order.
+	Failover Strategy = iota
+	// RoundRobin rotates through the healthy outbounds.
+	RoundRobin
+	// LeastLatency uses the healthy outbound with the fastest last probe.
+	LeastLatency
+	// ConsistentHash keeps each destination host on the same outbound
+	// while it stays healthy.
+	ConsistentHash
+)
+
+const (
+	DefaultProbeURL      = "http://www.gstatic.com/generate_204"
+	DefaultProbeInterval = time.Minute
+	DefaultProbeTimeout  = 5 * time.Second
+)
+
+// ErrNoOutbound is returned by OutboundGroup.Dial if the group is empty.
+var ErrNoOutbound = errors.New("tunnel: no outbound")
+
+// OutboundGroup dials through one of several outbounds. Outbounds whose
+// health probe or dial fails are taken out of rotation until a probe
+// succeeds again; if none is healthy, all of them are tried.
+type OutboundGroup struct {
+	Strategy Strategy
+
+	// ProbeURL is fetched through every outbound to check its health.
+	// Empty means DefaultProbeURL.
+	ProbeURL string
+
+	// ProbeInterval is the time between probe rounds.
+	// Zero means DefaultProbeInterval.
+	ProbeInterval time.Duration
+
+	// ProbeTimeout bounds each probe. Zero means DefaultProbeTimeout.
+	ProbeTimeout time.Duration
+
+	members []*member
+
+	mu   sync.Mutex
+	next int
+	stop chan struct{}
+}
+
+type member struct {
+	Outbound
+
+	key string
+
+	mu      sync.Mutex
+	healthy bool
+	latency time.Duration
+}
+
+func (m *member) state() (bool, time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.healthy, m.latency
+}
+
+func (m *member) setHealthy(healthy bool, latency time.Duration) {
+	m.mu.Lock()
+	m.healthy = healthy
+	if healthy {
+		m.latency = latency
+	}
+	m.mu.Unlock()
+}
+
+// NewOutboundGroup returns a group of outbounds, all initially healthy.
+func NewOutboundGroup(strategy Strategy, outbounds ...Outbound) *OutboundGroup {
+	g := &OutboundGroup{Strategy: strategy}
+	for i, o := range outbounds {
+		g.members = append(g.members, &member{Outbound: o, key: strconv.Itoa(i), healthy: true})
+	}
+	return g
+}
+
+// Dial connects to addr through the outbound chosen by the strategy and
+// falls back to the others in turn if that fails.
+func (g *OutboundGroup) Dial(ctx context.Context, addr Addr) (net.Conn, error) {
+	candidates := g.candidates(addr)
+	if len(candidates) == 0 {
+		return nil, ErrNoOutbound
+	}
+
+	var err error
+	for _, m := range candidates {
+		var conn net.Conn
+		conn, err = m.Dial(ctx, addr)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		m.setHealthy(false, 0)
+	}
+	return nil, err
+}
+
+// DialContext has the signature of net.Dialer.DialContext so it can back an http.Transport.
+func (g *OutboundGroup) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	addr := ParseAddr(address)
+	if addr == nil {
+		return nil, ErrAddressNotSupported
+	}
+	return g.Dial(ctx, addr)
+}
+
+// candidates orders the members by preference for addr.
+func (g *OutboundGroup) candidates(addr Addr) []*member {
+	var healthy, unhealthy []*member
+	latency := make(map[*member]time.Duration)
+	for _, m := range g.members {
+		ok, l := m.state()
+		if ok {
+			healthy = append(healthy, m)
+			latency[m] = l
+		} else {
+			unhealthy = append(unhealthy, m)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy, unhealthy = unhealthy, nil
+	}
+
+	switch g.Strategy {
+	case RoundRobin:
+		g.mu.Lock()
+		n := g.next % len(healthy)
+		g.next++
+		g.mu.Unlock()
+		rotated := make([]*member, 0, len(healthy))
+		rotated = append(rotated, healthy[n:]...)
+		healthy = append(rotated, healthy[:n]...)
+	case LeastLatency:
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return latency[healthy[i]] < latency[healthy[j]]
+		})
+	case ConsistentHash:
+		// Rendezvous hashing: members leaving the set only move their own hosts.
+		host := addr.String()
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		score := make(map[*member]uint64, len(healthy))
+		for _, m := range healthy {
+			h := fnv.New64a()
+			io.WriteString(h, m.key)
+			io.WriteString(h, host)
+			score[m] = h.Sum64()
+		}
+		sort.Slice(healthy, func(i, j int) bool {
+			return score[healthy[i]] > score[healthy[j]]
+		})
+	}
+
+	return append(healthy, unhealthy...)
+}
+
+// Start probes the outbounds every ProbeInterval until Close is called.
+func (g *OutboundGroup) Start() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.stop != nil {
+		return
+	}
+	g.stop = make(chan struct{})
+
+	interval := g.ProbeInterval
+	if interval <= 0 {
+		interval = DefaultProbeInterval
+	}
+
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			g.Probe(context.Background())
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}(g.stop)
+}
+
+// Close stops probing.
+func (g *OutboundGroup) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.stop != nil {
+		close(g.stop)
+		g.stop = nil
+	}
+	return nil
+}
+
+// Probe checks every outbound once, concurrently, by fetching ProbeURL
+// through it. Any response below 500 counts as healthy.
+func (g *OutboundGroup) Probe(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, m := range g.members {
+		wg.Add(1)
+		go func(m *member) {
+			defer wg.Done()
+			latency, err := g.probe(ctx, m)
+			m.setHealthy(err == nil, latency)
+		}(m)
+	}
+	wg.Wait()
+}
+
+func (g *OutboundGroup) probe(ctx context.Context, m *member) (time.Duration, error) {
+	url := g.ProbeURL
+	if url == "" {
+		url = DefaultProbeURL
+	}
+	timeout := g.ProbeTimeout
+	if timeout <= 0 {
+		timeout = DefaultProbeTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			addr := ParseAddr(address)
+			if addr == nil {
+				return nil, ErrAddressNotSupported
+			}
+			return m.Dial(ctx, addr)
+		},
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+
+	start := time.Now()
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	latency := time.Since(start)
+
+	if resp.StatusCode >= 500 {
+		return 0, errors.New("probe: " + resp.Status)
+	}
+	return latency, nil
+}
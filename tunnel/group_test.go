@@ -0,0 +1,155 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+type fakeOutbound struct {
+	fail  bool
+	dials atomic.Int32
+}
+
+func (f *fakeOutbound) Dial(ctx context.Context, addr Addr) (net.Conn, error) {
+	f.dials.Add(1)
+	if f.fail {
+		return nil, errors.New("dial failed")
+	}
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func dialCounts(outbounds ...*fakeOutbound) []int32 {
+	counts := make([]int32, len(outbounds))
+	for i, o := range outbounds {
+		counts[i] = o.dials.Load()
+	}
+	return counts
+}
+
+func TestOutboundGroupFailover(t *testing.T) {
+	a, b := &fakeOutbound{fail: true}, &fakeOutbound{}
+	g := NewOutboundGroup(Failover, a, b)
+
+	for i := 0; i < 3; i++ {
+		conn, err := g.Dial(context.Background(), ParseAddr("example.com:80"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	// The failed outbound is out of rotation after its first failure.
+	if got := dialCounts(a, b); got[0] != 1 || got[1] != 3 {
+		t.Fatalf("dials = %v", got)
+	}
+}
+
+func TestOutboundGroupRoundRobin(t *testing.T) {
+	outbounds := []*fakeOutbound{{}, {}, {}}
+	g := NewOutboundGroup(RoundRobin, outbounds[0], outbounds[1], outbounds[2])
+
+	for i := 0; i < 6; i++ {
+		conn, err := g.Dial(context.Background(), ParseAddr("example.com:80"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	for i, n := range dialCounts(outbounds...) {
+		if n != 2 {
+			t.Fatalf("outbound %d dialed %d times", i, n)
+		}
+	}
+}
+
+func TestOutboundGroupConsistentHash(t *testing.T) {
+	g := NewOutboundGroup(ConsistentHash, &fakeOutbound{}, &fakeOutbound{}, &fakeOutbound{}, &fakeOutbound{})
+
+	first := func(host string) *member {
+		return g.candidates(ParseAddr(host + ":443"))[0]
+	}
+
+	// The port doesn't matter and the choice is stable.
+	if g.candidates(ParseAddr("example.com:80"))[0] != first("example.com") {
+		t.Fatal("ports of one host use different outbounds")
+	}
+
+	before := make(map[string]*member)
+	for i := 0; i < 100; i++ {
+		host := "host" + strconv.Itoa(i) + ".example"
+		before[host] = first(host)
+	}
+
+	// Only the hosts of an unhealthy outbound move.
+	removed := g.members[1]
+	removed.setHealthy(false, 0)
+	for host, m := range before {
+		got := first(host)
+		if m == removed {
+			if got == removed {
+				t.Fatalf("%s still uses the unhealthy outbound", host)
+			}
+		} else if got != m {
+			t.Fatalf("%s moved to another outbound", host)
+		}
+	}
+}
+
+func TestOutboundGroupProbe(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer site.Close()
+
+	echo := echoServer(t)
+	defer echo.Close()
+
+	cc, stop := startGrpc(t, nil)
+	defer stop()
+	pool := NewGrpcPool([]string{cc.Target()}, 1, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	defer pool.Close()
+
+	dead := &TrojanOutbound{Server: "127.0.0.1:1", Password: testPassword}
+	live := &GrpcOutbound{Pool: pool, Password: testPassword}
+
+	g := NewOutboundGroup(LeastLatency, dead, live)
+	g.ProbeURL = site.URL
+	g.Probe(context.Background())
+
+	if ok, _ := g.members[0].state(); ok {
+		t.Fatal("unreachable outbound is healthy")
+	}
+	if ok, latency := g.members[1].state(); !ok || latency <= 0 {
+		t.Fatalf("gRPC outbound: healthy %v, latency %v", ok, latency)
+	}
+
+	conn, err := g.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	conn.(interface{ CloseWrite() error }).CloseWrite()
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("echo = %q", got)
+	}
+}
@@ -0,0 +1,176 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Blocked233/middleware/proto"
+
+	"google.golang.org/grpc/peer"
+)
+
+// streamConn adapts a Message.Tun stream to net.Conn. Messages are
+// concatenated into a byte stream; every Write is sent as one message.
+// Deadlines are not supported, the stream ends with its context.
+//
+// The stream handler must not return before the conn is closed, see done:
+// gRPC doesn't allow Send once the handler has returned.
+type streamConn struct {
+	stream  proto.Message_TunServer
+	recv    proto.TunByte
+	pending []byte
+
+	writeMu sync.Mutex
+	send    proto.TunByte
+	closed  atomic.Bool
+
+	// done is closed by Close once no Write is in flight.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newStreamConn(stream proto.Message_TunServer) *streamConn {
+	return &streamConn{stream: stream, done: make(chan struct{})}
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.closed.Load() {
+			return 0, net.ErrClosed
+		}
+		if err := c.stream.RecvMsg(&c.recv); err != nil {
+			return 0, err
+		}
+		c.pending = c.recv.Data
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+
+	// Send serializes the message before returning, so b is not retained.
+	c.send.Data = b
+	err := c.stream.Send(&c.send)
+	c.send.Data = nil
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close stops further reads and writes and releases the stream handler,
+// which finishes the stream. A Read blocked in RecvMsg fails at that point.
+func (c *streamConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.writeMu.Lock()
+		c.closed.Store(true)
+		c.writeMu.Unlock()
+		close(c.done)
+	})
+	return nil
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	if p, ok := peer.FromContext(c.stream.Context()); ok {
+		return p.Addr
+	}
+	return &net.TCPAddr{}
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// clientConn adapts a client Message.Tun stream to net.Conn. Close cancels
+// the stream, CloseWrite half-closes it.
+type clientConn struct {
+	stream  proto.Message_TunClient
+	cancel  context.CancelFunc
+	recv    proto.TunByte
+	pending []byte
+
+	writeMu sync.Mutex
+	send    proto.TunByte
+	closed  bool
+}
+
+func newClientConn(stream proto.Message_TunClient, cancel context.CancelFunc) *clientConn {
+	return &clientConn{stream: stream, cancel: cancel}
+}
+
+func (c *clientConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if err := c.stream.RecvMsg(&c.recv); err != nil {
+			return 0, err
+		}
+		c.pending = c.recv.Data
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *clientConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+
+	c.send.Data = b
+	err := c.stream.Send(&c.send)
+	c.send.Data = nil
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *clientConn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.stream.CloseSend()
+}
+
+func (c *clientConn) Close() error {
+	c.cancel()
+	return nil
+}
+
+func (c *clientConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *clientConn) RemoteAddr() net.Addr {
+	if p, ok := peer.FromContext(c.stream.Context()); ok {
+		return p.Addr
+	}
+	return &net.TCPAddr{}
+}
+
+func (c *clientConn) SetDeadline(t time.Time) error      { return nil }
+func (c *clientConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *clientConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,275 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Blocked233/middleware/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/keepalive"
+)
+
+const (
+	// DefaultGrpcPoolSize is the number of connections kept per target.
+	DefaultGrpcPoolSize = 2
+
+	DefaultGrpcKeepaliveTime    = 30 * time.Second
+	DefaultGrpcKeepaliveTimeout = 10 * time.Second
+
+	// grpcKeepaliveMinTime is the shortest client ping interval servers
+	// created by NewGrpcServer accept.
+	grpcKeepaliveMinTime = 10 * time.Second
+
+	grpcReplaceMaxDelay = 30 * time.Second
+)
+
+// ErrPoolClosed is returned by GrpcPool.Tun after Close has been called.
+var ErrPoolClosed = errors.New("tunnel: pool closed")
+
+// GrpcPool keeps connections to one or more tunnel servers and spreads Tun
+// streams over them, preferring the connection with the fewest streams.
+// Connections are pinged while idle so NATs keep them open, and replaced
+// when they fail.
+type GrpcPool struct {
+	// Targets are the server addresses, in grpc.Dial syntax.
+	Targets []string
+
+	// Size is the number of connections per target.
+	// Zero means DefaultGrpcPoolSize.
+	Size int
+
+	// DialOptions are passed to grpc.Dial after the pool's own options and
+	// must at least set the transport credentials.
+	DialOptions []grpc.DialOption
+
+	// KeepaliveTime is the ping interval. Zero means DefaultGrpcKeepaliveTime;
+	// servers from NewGrpcServer reject intervals below 10s.
+	KeepaliveTime time.Duration
+
+	// KeepaliveTimeout closes a connection whose ping isn't answered in time.
+	// Zero means DefaultGrpcKeepaliveTimeout.
+	KeepaliveTimeout time.Duration
+
+	mu     sync.Mutex
+	conns  []*pooledConn
+	next   int
+	closed bool
+}
+
+type pooledConn struct {
+	target  string
+	cc      *grpc.ClientConn
+	streams atomic.Int32
+}
+
+// NewGrpcPool returns a pool with size connections to each target.
+func NewGrpcPool(targets []string, size int, opts ...grpc.DialOption) *GrpcPool {
+	return &GrpcPool{Targets: targets, Size: size, DialOptions: opts}
+}
+
+// Tun opens a Message.Tun stream on the least loaded healthy connection.
+func (p *GrpcPool) Tun(ctx context.Context, opts ...grpc.CallOption) (proto.Message_TunClient, error) {
+	if err := p.init(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	tried := make(map[*pooledConn]bool)
+	for {
+		pc := p.pick(tried)
+		if pc == nil {
+			if err == nil {
+				err = ErrPoolClosed
+			}
+			return nil, err
+		}
+		tried[pc] = true
+
+		pc.streams.Add(1)
+		var stream proto.Message_TunClient
+		stream, err = proto.NewMessageClient(pc.cc).Tun(ctx, opts...)
+		if err != nil {
+			pc.streams.Add(-1)
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// The stream context is done once the stream has finished.
+		go func() {
+			<-stream.Context().Done()
+			pc.streams.Add(-1)
+		}()
+		return stream, nil
+	}
+}
+
+// Close closes every connection, which ends their streams.
+func (p *GrpcPool) Close() error {
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = nil
+	p.closed = true
+	p.mu.Unlock()
+
+	for _, pc := range conns {
+		pc.cc.Close()
+	}
+	return nil
+}
+
+func (p *GrpcPool) init() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return ErrPoolClosed
+	}
+	if p.conns != nil {
+		return nil
+	}
+
+	size := p.Size
+	if size <= 0 {
+		size = DefaultGrpcPoolSize
+	}
+
+	conns := make([]*pooledConn, 0, size*len(p.Targets))
+	for i := 0; i < size; i++ {
+		for _, target := range p.Targets {
+			pc, err := p.dial(target)
+			if err != nil {
+				for _, pc := range conns {
+					pc.cc.Close()
+				}
+				return err
+			}
+			conns = append(conns, pc)
+		}
+	}
+
+	p.conns = conns
+	for _, pc := range conns {
+		go p.watch(pc)
+	}
+	return nil
+}
+
+func (p *GrpcPool) dial(target string) (*pooledConn, error) {
+	keepaliveTime := p.KeepaliveTime
+	if keepaliveTime <= 0 {
+		keepaliveTime = DefaultGrpcKeepaliveTime
+	}
+	keepaliveTimeout := p.KeepaliveTimeout
+	if keepaliveTimeout <= 0 {
+		keepaliveTimeout = DefaultGrpcKeepaliveTimeout
+	}
+
+	opts := append([]grpc.DialOption{
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                keepaliveTime,
+			Timeout:             keepaliveTimeout,
+			PermitWithoutStream: true,
+		}),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(Codec{})),
+	}, p.DialOptions...)
+
+	cc, err := grpc.Dial(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// Connect right away so idle connections are kept alive.
+	cc.Connect()
+	return &pooledConn{target: target, cc: cc}, nil
+}
+
+// pick returns the healthy connection with the fewest streams, skipping
+// tried ones. Ties are broken round robin. Connections that are failing are
+// used only if nothing else is left.
+func (p *GrpcPool) pick(tried map[*pooledConn]bool) *pooledConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var best *pooledConn
+	bestHealthy := false
+	n := len(p.conns)
+	for i := 0; i < n; i++ {
+		pc := p.conns[(p.next+i)%n]
+		if tried[pc] {
+			continue
+		}
+		healthy := pc.cc.GetState() != connectivity.TransientFailure
+		switch {
+		case best == nil,
+			healthy && !bestHealthy,
+			healthy == bestHealthy && pc.streams.Load() < best.streams.Load():
+			best, bestHealthy = pc, healthy
+		}
+	}
+	if n > 0 {
+		p.next = (p.next + 1) % n
+	}
+	return best
+}
+
+// watch replaces pc with a fresh connection when it fails, backing off
+// while replacements keep failing before they become ready.
+func (p *GrpcPool) watch(pc *pooledConn) {
+	var delay time.Duration
+	for {
+		state := pc.cc.GetState()
+		switch state {
+		case connectivity.Shutdown:
+			return
+		case connectivity.Ready:
+			delay = 0
+		case connectivity.TransientFailure:
+			if delay == 0 {
+				delay = time.Second
+			} else if delay *= 2; delay > grpcReplaceMaxDelay {
+				delay = grpcReplaceMaxDelay
+			}
+			time.Sleep(delay)
+
+			if pc = p.replace(pc); pc == nil {
+				return
+			}
+			continue
+		}
+		pc.cc.WaitForStateChange(context.Background(), state)
+	}
+}
+
+// replace swaps old for a new connection to the same target and closes old.
+// It returns nil if old is no longer part of the pool.
+func (p *GrpcPool) replace(old *pooledConn) *pooledConn {
+	pc, err := p.dial(old.target)
+
+	p.mu.Lock()
+	i := 0
+	for i < len(p.conns) && p.conns[i] != old {
+		i++
+	}
+	if i == len(p.conns) || err != nil {
+		p.mu.Unlock()
+		if pc != nil {
+			pc.cc.Close()
+		}
+		if err == nil {
+			return nil
+		}
+		// Keep the old connection; grpc keeps retrying it.
+		return old
+	}
+	p.conns[i] = pc
+	p.mu.Unlock()
+
+	old.cc.Close()
+	return pc
+}
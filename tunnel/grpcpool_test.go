@@ -0,0 +1,141 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Blocked233/middleware/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func echoHandler(conn net.Conn) {
+	io.Copy(conn, conn)
+}
+
+func serveGrpc(ln net.Listener) *grpc.Server {
+	server := NewGrpcServer(echoHandler)
+	go server.Serve(ln)
+	return server
+}
+
+func pingTun(stream proto.Message_TunClient) error {
+	if err := stream.Send(&proto.TunByte{Data: []byte("ping")}); err != nil {
+		return err
+	}
+	msg, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if string(msg.Data) != "ping" {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func TestGrpcPoolBalance(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := serveGrpc(ln)
+	defer server.Stop()
+
+	pool := NewGrpcPool([]string{ln.Addr().String()}, 3, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	defer pool.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	for i := 0; i < 6; i++ {
+		stream, err := pool.Tun(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pingTun(stream); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pool.mu.Lock()
+	for _, pc := range pool.conns {
+		if n := pc.streams.Load(); n != 2 {
+			t.Errorf("connection has %d streams, want 2", n)
+		}
+	}
+	pool.mu.Unlock()
+
+	// Finished streams are no longer counted.
+	cancel()
+	pool.mu.Lock()
+	conns := pool.conns
+	pool.mu.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, pc := range conns {
+		for pc.streams.Load() != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("connection still has %d streams", pc.streams.Load())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestGrpcPoolReplace(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	server := serveGrpc(ln)
+
+	pool := NewGrpcPool([]string{addr}, 1, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	defer pool.Close()
+
+	stream, err := pool.Tun(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pingTun(stream); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restart the server; new streams must work again once it is back.
+	server.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip("can't listen on the old address:", err)
+	}
+	server = serveGrpc(ln)
+	defer server.Stop()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		stream, err := pool.Tun(ctx, grpc.WaitForReady(true))
+		if err == nil {
+			err = pingTun(stream)
+		}
+		cancel()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGrpcPoolClosed(t *testing.T) {
+	pool := NewGrpcPool([]string{"127.0.0.1:1"}, 1, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	pool.Close()
+
+	if _, err := pool.Tun(context.Background()); err != ErrPoolClosed {
+		t.Fatalf("Tun after Close: %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package tunnel
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HTTPProxy is an HTTP proxy supporting CONNECT over HTTP/1.1 and HTTP/2
+// as well as absolute-URI forwarding. It can be used as an http.Handler or,
+// through Handle, as gin middleware.
+type HTTPProxy struct {
+	// Users authenticates clients with Basic credentials. Nil disables auth,
+	// an empty store rejects every client.
+	Users *UserStore
+
+	// Egress dials destinations. Nil means DefaultEgress.
+	Egress *Egress
+
+	// Realm is sent in the Proxy-Authenticate challenge.
+	Realm string
+
+	once    sync.Once
+	forward *httputil.ReverseProxy
+}
+
+// NewHTTPProxy returns an HTTPProxy authenticating against Users. No
+// client gets through until users are added.
+func NewHTTPProxy() *HTTPProxy {
+	return &HTTPProxy{Users: Users, Realm: "proxy"}
+}
+
+// Handle serves proxy requests and passes everything else to the next gin handler.
+func (p *HTTPProxy) Handle(c *gin.Context) {
+	if !isProxyRequest(c.Request) {
+		c.Next()
+		return
+	}
+	p.ServeHTTP(c.Writer, c.Request)
+	c.Abort()
+}
+
+func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !p.authenticate(r) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="`+p.Realm+`"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		p.connect(w, r)
+		return
+	}
+
+	if !r.URL.IsAbs() {
+		http.Error(w, "absolute URI required", http.StatusBadRequest)
+		return
+	}
+
+	p.once.Do(p.init)
+	p.forward.ServeHTTP(w, r)
+}
+
+func (p *HTTPProxy) init() {
+	p.forward = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.Header.Del("Proxy-Authorization")
+			r.Header.Del("Proxy-Connection")
+			// Don't reveal the client address to the destination.
+			r.Header["X-Forwarded-For"] = nil
+		},
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         p.egress().DialContext,
+			MaxIdleConnsPerHost: 8,
+		},
+	}
+}
+
+func (p *HTTPProxy) connect(w http.ResponseWriter, r *http.Request) {
+	addr := ParseAddr(r.Host)
+	if addr == nil {
+		http.Error(w, "bad host", http.StatusBadRequest)
+		return
+	}
+
+	conn, err := p.egress().Dial("tcp", addr)
+	if err != nil {
+		if errors.Is(err, ErrNotAllowed) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+
+	if r.ProtoMajor == 1 {
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+			return
+		}
+
+		clientConn, rw, err := hijacker.Hijack()
+		if err != nil {
+			return
+		}
+		defer clientConn.Close()
+
+		if _, err := io.WriteString(clientConn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+			return
+		}
+
+		// The client may have pipelined data after the request.
+		if n := rw.Reader.Buffered(); n > 0 {
+			buffered, _ := rw.Reader.Peek(n)
+			if _, err := conn.Write(buffered); err != nil {
+				return
+			}
+		}
+
+		relay(clientConn, conn)
+		return
+	}
+
+	// HTTP/2 CONNECT: the stream itself is the tunnel.
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	go func() {
+		io.Copy(conn, r.Body)
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		}
+	}()
+	io.Copy(flushWriter{w, flusher}, conn)
+}
+
+func (p *HTTPProxy) authenticate(r *http.Request) bool {
+	if p.Users == nil {
+		return true
+	}
+	if p.Users.Len() == 0 {
+		return false
+	}
+
+	// Authorization belongs to the destination, never read it here.
+	auth := r.Header.Get("Proxy-Authorization")
+
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return false
+	}
+
+	name, password, ok := strings.Cut(string(decoded), ":")
+	return ok && p.Users.Auth(name, password)
+}
+
+func (p *HTTPProxy) egress() *Egress {
+	if p.Egress != nil {
+		return p.Egress
+	}
+	return DefaultEgress
+}
+
+func isProxyRequest(r *http.Request) bool {
+	return r.Method == http.MethodConnect || r.URL.IsAbs()
+}
+
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (f flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	if f.flusher != nil {
+		f.flusher.Flush()
+	}
+	return n, err
+}
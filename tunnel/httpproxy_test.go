@@ -0,0 +1,222 @@
+package tunnel
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func basic(name, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(name+":"+password))
+}
+
+// newTestHTTPProxy returns a proxy admitting alice with password secret.
+func newTestHTTPProxy() *HTTPProxy {
+	users := NewUserStore()
+	users.Add("alice", "secret")
+	return &HTTPProxy{Users: users, Egress: &Egress{}, Realm: "proxy"}
+}
+
+func TestHTTPProxyAuth(t *testing.T) {
+	users := NewUserStore()
+	p := &HTTPProxy{Users: users, Realm: "proxy"}
+
+	for _, tt := range []struct {
+		name   string
+		add    bool
+		header string
+		auth   string
+		ok     bool
+	}{
+		// An empty store admits no one, not even an empty login.
+		{"empty store", false, "Proxy-Authorization", basic("", ""), false},
+		{"empty store, no credentials", false, "", "", false},
+		{"valid", true, "Proxy-Authorization", basic("alice", "secret"), true},
+		{"wrong password", true, "Proxy-Authorization", basic("alice", "1234"), false},
+		{"unknown user", true, "Proxy-Authorization", basic("", "secret"), false},
+		{"no credentials", true, "", "", false},
+		// Authorization is meant for the destination.
+		{"Authorization only", true, "Authorization", basic("alice", "secret"), false},
+	} {
+		if tt.add {
+			users.Add("alice", "secret")
+		}
+
+		r := httptest.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.auth)
+		}
+		if got := p.authenticate(r); got != tt.ok {
+			t.Errorf("%s: authenticate = %v, want %v", tt.name, got, tt.ok)
+		}
+	}
+
+	// Rejected requests get the Basic challenge.
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodConnect, "http://example.com:443", nil))
+	if w.Code != http.StatusProxyAuthRequired || w.Header().Get("Proxy-Authenticate") != `Basic realm="proxy"` {
+		t.Fatalf("status %d, Proxy-Authenticate %q", w.Code, w.Header().Get("Proxy-Authenticate"))
+	}
+}
+
+func TestHTTPProxyConnect(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	server := httptest.NewServer(newTestHTTPProxy())
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Data pipelined after the request reaches the destination too.
+	target := echo.Addr().String()
+	request := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target +
+		"\r\nProxy-Authorization: " + basic("alice", "secret") + "\r\n\r\nhello"
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+
+	if _, err := io.WriteString(conn, " world"); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len("hello world"))
+	if _, err := io.ReadFull(br, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello world" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestHTTPProxyConnectHTTP2(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	server := httptest.NewUnstartedServer(newTestHTTPProxy())
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	transport := &http2.Transport{TLSClientConfig: server.Client().Transport.(*http.Transport).TLSClientConfig}
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(http.MethodConnect, server.URL, pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = echo.Addr().String()
+	req.Header.Set("Proxy-Authorization", basic("alice", "secret"))
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+
+	// Every echoed chunk is flushed to the stream as it arrives.
+	for _, msg := range []string{"hello", "world"} {
+		if _, err := io.WriteString(pw, msg); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(resp.Body, got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != msg {
+			t.Fatalf("got %q, want %q", got, msg)
+		}
+	}
+	pw.Close()
+}
+
+func TestHTTPProxyForward(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+	server := httptest.NewServer(newTestHTTPProxy())
+	defer server.Close()
+
+	proxyURL, _ := url.Parse(server.URL)
+	proxyURL.User = url.UserPassword("alice", "secret")
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL, nil)
+	req.Header.Set("Authorization", "Bearer origin")
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Fatalf("status %d, body %q", resp.StatusCode, body)
+	}
+
+	header := <-headers
+	for _, name := range []string{"Proxy-Authorization", "Proxy-Connection", "X-Forwarded-For"} {
+		if value := header.Get(name); value != "" {
+			t.Errorf("%s forwarded: %q", name, value)
+		}
+	}
+	// The destination's own credentials pass untouched.
+	if got := header.Get("Authorization"); got != "Bearer origin" {
+		t.Errorf("Authorization %q", got)
+	}
+}
+
+func TestHTTPProxyDialErrors(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	denied := newTestHTTPProxy()
+	denied.Egress.Allow = func(string, Addr) bool { return false }
+
+	for _, tt := range []struct {
+		name   string
+		proxy  *HTTPProxy
+		target string
+		status int
+	}{
+		{"denied", denied, echo.Addr().String(), http.StatusForbidden},
+		{"refused", newTestHTTPProxy(), closed.Addr().String(), http.StatusBadGateway},
+	} {
+		r := httptest.NewRequest(http.MethodConnect, tt.target, nil)
+		r.Header.Set("Proxy-Authorization", basic("alice", "secret"))
+		w := httptest.NewRecorder()
+		tt.proxy.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+)
+
+// DefaultSniffTimeout bounds how long MuxServer waits for the first bytes of a connection.
+const DefaultSniffTimeout = 5 * time.Second
+
+type tlsStateKey struct{}
+
+// MuxServer serves Trojan, the gRPC tunnel and an HTTP handler on a single
+// TLS port. Each connection is sniffed after the handshake: a valid Trojan
+// password goes to the embedded TrojanServer's Handler, HandleTrojan if nil,
+// HTTP/2 requests with an application/grpc content type go to GRPC and
+// everything else goes to HTTP.
+type MuxServer struct {
+	TrojanServer
+
+	// GRPC serves gRPC requests. Nil means GrpcServer. Requests reach it
+	// through its ServeHTTP, so its transport options don't apply: the
+	// connection window is that of NewGrpcServer, and pings are always
+	// answered, whether or not streams are open.
+	GRPC *grpc.Server
+
+	// HTTP serves all other requests, e.g. a *gin.Engine.
+	HTTP http.Handler
+
+	// SniffTimeout bounds the wait for the first bytes of a connection.
+	// Zero means DefaultSniffTimeout.
+	SniffTimeout time.Duration
+
+	once       sync.Once
+	h1         *connListener
+	httpServer *http.Server
+	h2Server   *http2.Server
+}
+
+// NewMuxServer returns a MuxServer listening on addr with the given certificates.
+func NewMuxServer(addr string, certs *CertStore, handler http.Handler) *MuxServer {
+	return &MuxServer{
+		TrojanServer: TrojanServer{Addr: addr, Certs: certs},
+		HTTP:         handler,
+	}
+}
+
+// ListenAndServe listens on m.Addr and calls Serve.
+func (m *MuxServer) ListenAndServe() error {
+	addr := m.Addr
+	if addr == "" {
+		addr = ":443"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return m.Serve(ln)
+}
+
+// Serve accepts TLS connections on ln and dispatches them by protocol.
+func (m *MuxServer) Serve(ln net.Listener) error {
+	m.once.Do(m.init)
+	return m.TrojanServer.serve(ln, m.dispatch)
+}
+
+// Close stops the listeners and the HTTP server. Like with TrojanServer,
+// active connections, HTTP and gRPC ones included, are not interrupted.
+func (m *MuxServer) Close() error {
+	m.once.Do(m.init)
+	err := m.TrojanServer.Close()
+	m.h1.Close()
+	return err
+}
+
+func (m *MuxServer) init() {
+	if len(m.NextProtos) == 0 {
+		m.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	}
+
+	m.h1 = newConnListener()
+	m.httpServer = &http.Server{
+		Handler: m.handler(),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			if cs, ok := c.(interface{ ConnectionState() tls.ConnectionState }); ok {
+				state := cs.ConnectionState()
+				ctx = context.WithValue(ctx, tlsStateKey{}, &state)
+			}
+			return ctx
+		},
+	}
+	// Match NewGrpcServer's transport settings. The HTTP/2 server has no
+	// ping policy, keepalives like GrpcPool's are never answered with GOAWAY.
+	m.h2Server = &http2.Server{MaxUploadBufferPerConnection: grpcConnWindowSize}
+
+	go m.httpServer.Serve(m.h1)
+}
+
+func (m *MuxServer) handler() http.Handler {
+	grpcServer := m.GRPC
+	if grpcServer == nil {
+		grpcServer = GrpcServer
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			r.TLS, _ = r.Context().Value(tlsStateKey{}).(*tls.ConnectionState)
+		}
+
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			grpcServer.ServeHTTP(w, r)
+			return
+		}
+
+		if m.HTTP == nil {
+			http.NotFound(w, r)
+			return
+		}
+		m.HTTP.ServeHTTP(w, r)
+	})
+}
+
+func (m *MuxServer) dispatch(conn net.Conn) {
+	timeout := m.SniffTimeout
+	if timeout <= 0 {
+		timeout = DefaultSniffTimeout
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	peeked, trojan, err := sniffTrojan(conn)
+	if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	sc := newSniffConn(conn, peeked)
+
+	if trojan {
+		m.trojanHandler()(sc)
+		return
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok && tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		m.h2Server.ServeConn(sc, &http2.ServeConnOpts{
+			Handler:    m.httpServer.Handler,
+			BaseConfig: m.httpServer,
+			Context:    m.httpServer.ConnContext(context.Background(), sc),
+		})
+		return
+	}
+
+	if m.h1.put(sc) {
+		// The HTTP server owns the connection until it closes it.
+		<-sc.done
+	}
+}
+
+// sniffTrojan reads until it can tell whether conn starts with a known Trojan
+// password followed by CRLF. The bytes read are returned so they can be replayed.
+// Trojan sends the hash as lowercase hex, like the store indexes it, so a
+// connection starting with an uppercase digit is not Trojan.
+func sniffTrojan(conn net.Conn) ([]byte, bool, error) {
+	buf := make([]byte, trojanPasswordLenth+len(crlf))
+	n := 0
+	for n < len(buf) {
+		m, err := conn.Read(buf[n:])
+		if m == 0 && err != nil {
+			return buf[:n], false, err
+		}
+
+		read := buf[:n+m]
+		for ; n < len(read); n++ {
+			if n < trojanPasswordLenth && !isHexDigit(read[n]) {
+				return read, false, nil
+			}
+		}
+	}
+
+	trojan := isTrojanPassword(buf[:trojanPasswordLenth]) && string(buf[trojanPasswordLenth:]) == string(crlf)
+	return buf, trojan, nil
+}
+
+// isHexDigit reports whether c is a lowercase hex digit.
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f'
+}
+
+// sniffConn replays the sniffed bytes before reading from the connection.
+type sniffConn struct {
+	net.Conn
+	peeked []byte
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newSniffConn(conn net.Conn, peeked []byte) *sniffConn {
+	return &sniffConn{Conn: conn, peeked: peeked, done: make(chan struct{})}
+}
+
+func (c *sniffConn) Read(b []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(b, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *sniffConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.Conn.Close()
+		close(c.done)
+	})
+	return err
+}
+
+// ConnectionState lets HTTP/2 and ConnContext see the TLS state of the wrapped connection.
+func (c *sniffConn) ConnectionState() tls.ConnectionState {
+	if tlsConn, ok := c.Conn.(*tls.Conn); ok {
+		return tlsConn.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+// connListener is a net.Listener fed by MuxServer.
+type connListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *connListener) put(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.closed:
+		return false
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
@@ -0,0 +1,202 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Blocked233/middleware/proto"
+
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// startMux serves Trojan, the gRPC tunnel and an HTTP handler reporting the
+// request protocol on one TLS listener.
+func startMux(t *testing.T) (*MuxServer, string) {
+	dir := t.TempDir()
+	writeCert(t, dir, "mux", "mux.example")
+	certs, err := NewCertStore(filepath.Join(dir, "mux.crt"), filepath.Join(dir, "mux.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMuxServer("", certs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	m.GRPC = NewGrpcServer(nil)
+	m.SniffTimeout = time.Second
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go m.Serve(ln)
+	t.Cleanup(func() {
+		m.Close()
+		m.GRPC.Stop()
+	})
+	return m, ln.Addr().String()
+}
+
+// trojanConnect returns a Trojan CONNECT request to target.
+func trojanConnect(password, target string) []byte {
+	header := append(hexSha224([]byte(password)), crlf...)
+	header = append(header, CmdConnect)
+	header = append(header, ParseAddr(target)...)
+	return append(header, crlf...)
+}
+
+func TestMuxTrojan(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	_, addr := startMux(t)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Trojan is recognized whatever ALPN negotiated.
+	if _, err := conn.Write(append(trojanConnect(testPassword, echo.Addr().String()), "hello"...)); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len("hello"))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("echo = %q", got)
+	}
+}
+
+func TestMuxHTTP(t *testing.T) {
+	_, addr := startMux(t)
+	config := &tls.Config{InsecureSkipVerify: true}
+
+	for proto, transport := range map[string]http.RoundTripper{
+		"HTTP/1.1": &http.Transport{TLSClientConfig: config},
+		"HTTP/2.0": &http2.Transport{TLSClientConfig: config},
+	} {
+		resp, err := (&http.Client{Transport: transport}).Get("https://" + addr + "/")
+		if err != nil {
+			t.Fatalf("%s: %v", proto, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != proto {
+			t.Errorf("%s: status %d, handler saw %q", proto, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestMuxGrpc(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	_, addr := startMux(t)
+
+	cc, err := grpc.Dial(addr, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	stream, err := proto.NewMessageClient(cc).Tun(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&proto.TunByte{Data: append(trojanConnect(testPassword, echo.Addr().String()), "hello"...)}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Data) != "hello" {
+		t.Fatalf("echo = %q", msg.Data)
+	}
+}
+
+func TestMuxClose(t *testing.T) {
+	m, addr := startMux(t)
+	config := &tls.Config{InsecureSkipVerify: true}
+
+	clients := map[string]*http.Client{
+		"HTTP/1.1": {Transport: &http.Transport{TLSClientConfig: config}},
+		"HTTP/2.0": {Transport: &http2.Transport{TLSClientConfig: config}},
+	}
+	get := func(client *http.Client) error {
+		resp, err := client.Get("https://" + addr + "/")
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		return resp.Body.Close()
+	}
+	for proto, client := range clients {
+		if err := get(client); err != nil {
+			t.Fatalf("%s: %v", proto, err)
+		}
+	}
+
+	m.Close()
+
+	// Open connections keep working, new ones are refused.
+	for proto, client := range clients {
+		if err := get(client); err != nil {
+			t.Errorf("%s: open connection: %v", proto, err)
+		}
+	}
+	if err := get(&http.Client{Transport: &http.Transport{TLSClientConfig: config}}); err == nil {
+		t.Error("new connection accepted after Close")
+	}
+}
+
+func TestSniffTrojan(t *testing.T) {
+	// net.Pipe hands each Read as much as fits, so the sniffer sees the
+	// data in one piece unless it stops early.
+	valid := string(trojanConnect(testPassword, "example.com:80"))
+	unknown := string(trojanConnect("unknown", "example.com:80"))
+
+	for _, tt := range []struct {
+		name   string
+		data   string
+		trojan bool
+	}{
+		{"valid", valid, true},
+		{"unknown password", unknown, false},
+		// The store holds lowercase hashes, so uppercase ones are not Trojan.
+		{"uppercase", strings.ToUpper(valid), false},
+		{"no CRLF", valid[:trojanPasswordLenth] + "\n\n", false},
+		{"HTTP/1.1", "GET / HTTP/1.1\r\n\r\n", false},
+		{"HTTP/2", http2.ClientPreface, false},
+	} {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte(tt.data))
+		}()
+
+		peeked, trojan, err := sniffTrojan(server)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		// Everything read is handed back for replay.
+		want := tt.data
+		if len(want) > trojanPasswordLenth+len(crlf) {
+			want = want[:trojanPasswordLenth+len(crlf)]
+		}
+		if trojan != tt.trojan || string(peeked) != want {
+			t.Errorf("%s: trojan %v, peeked %q", tt.name, trojan, peeked)
+		}
+		client.Close()
+		server.Close()
+	}
+}
@@ -0,0 +1,77 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// Outbound opens TCP connections through a tunnel server.
+type Outbound interface {
+	// Dial connects to addr through the server.
+	Dial(ctx context.Context, addr Addr) (net.Conn, error)
+}
+
+// trojanRequest builds a Trojan CONNECT header for addr.
+func trojanRequest(password string, addr Addr) []byte {
+	req := make([]byte, 0, trojanPasswordLenth+len(crlf)+1+len(addr)+len(crlf))
+	req = append(req, hexSha224([]byte(password))...)
+	req = append(req, crlf...)
+	req = append(req, CmdConnect)
+	req = append(req, addr...)
+	req = append(req, crlf...)
+	return req
+}
+
+// TrojanOutbound dials a Trojan server over TLS.
+type TrojanOutbound struct {
+	// Server is the host:port of the Trojan server.
+	Server   string
+	Password string
+
+	// TLSConfig is used for the handshake. Nil uses the server name from Server.
+	TLSConfig *tls.Config
+
+	Dialer net.Dialer
+}
+
+func (t *TrojanOutbound) Dial(ctx context.Context, addr Addr) (net.Conn, error) {
+	dialer := tls.Dialer{NetDialer: &t.Dialer, Config: t.TLSConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", t.Server)
+	if err != nil {
+		return nil, err
+	}
+
+	// The server doesn't answer the request; the header goes out with the
+	// handshake flight and any error shows up on the first Read.
+	if _, err := conn.Write(trojanRequest(t.Password, addr)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// GrpcOutbound opens Trojan sessions as Message.Tun streams of a GrpcPool.
+type GrpcOutbound struct {
+	Pool     *GrpcPool
+	Password string
+}
+
+func (g *GrpcOutbound) Dial(ctx context.Context, addr Addr) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// The stream lives until the conn is closed, not as long as ctx. Tun
+	// fails fast instead of waiting for a connection to become ready.
+	streamCtx, cancel := context.WithCancel(context.Background())
+	stream, err := g.Pool.Tun(streamCtx)
+	if err == nil {
+		conn := newClientConn(stream, cancel)
+		if _, err = conn.Write(trojanRequest(g.Password, addr)); err == nil {
+			return conn, nil
+		}
+	}
+	cancel()
+	return nil, err
+}
@@ -10,12 +10,19 @@ type byteReuse struct {
 	buf []byte
 }
 
+// Buffer tiers. Pick the smallest one that fits the use:
+// small for protocol headers, medium for stream chunks and gRPC messages,
+// large for UDP packets and bulk copies.
+const (
+	smallBufferSize  = 2 * 1024
+	mediumBufferSize = 16 * 1024
+	largeBufferSize  = 64 * 1024
+)
+
+var bufferSizes = [...]int{smallBufferSize, mediumBufferSize, largeBufferSize}
+
 var (
-	bufferPool = sync.Pool{
-		New: func() interface{} {
-			return &byteReuse{buf: make([]byte, 1500)}
-		},
-	}
+	bufferPools [len(bufferSizes)]sync.Pool
 
 	tunBytesPool = sync.Pool{
 		New: func() interface{} {
@@ -23,3 +30,52 @@ var (
 		},
 	}
 )
+
+func init() {
+	for i := range bufferPools {
+		size := bufferSizes[i]
+		bufferPools[i].New = func() interface{} {
+			return &byteReuse{buf: make([]byte, size)}
+		}
+	}
+}
+
+// bufferTier returns the index of the smallest tier holding size bytes,
+// or the largest tier.
+func bufferTier(size int) int {
+	for i, s := range bufferSizes {
+		if size <= s {
+			return i
+		}
+	}
+	return len(bufferSizes) - 1
+}
+
+// getBuffer returns a pooled buffer of at least size bytes, capped at
+// largeBufferSize. Return it with putBuffer.
+func getBuffer(size int) *byteReuse {
+	return bufferPools[bufferTier(size)].Get().(*byteReuse)
+}
+
+// putBuffer returns b to its tier. Buffers that were reallocated by append
+// no longer match a tier and are left to the garbage collector.
+func putBuffer(b *byteReuse) {
+	b.buf = b.buf[:cap(b.buf)]
+	for i, s := range bufferSizes {
+		if len(b.buf) == s {
+			bufferPools[i].Put(b)
+			return
+		}
+	}
+}
+
+func getTunByte() *proto.TunByte {
+	return tunBytesPool.Get().(*proto.TunByte)
+}
+
+// putTunByte returns m to the pool. The caller must own m: no Send or
+// RecvMsg using it may still be in flight.
+func putTunByte(m *proto.TunByte) {
+	m.Data = nil
+	tunBytesPool.Put(m)
+}
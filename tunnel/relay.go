@@ -0,0 +1,91 @@
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// relayLingerTimeout bounds how long the client may keep sending after the
+// destination has finished.
+const relayLingerTimeout = 10 * time.Second
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// relay copies data between client and remote in both directions and
+// returns once both are done. Half-closes are propagated when supported.
+// The caller closes both connections.
+func relay(client, remote net.Conn) {
+	done := make(chan struct{})
+
+	// client --> destination
+	go func() {
+		defer close(done)
+
+		_, err := copyConn(remote, client)
+		if err != nil || !closeWrite(remote) {
+			remote.Close()
+		}
+	}()
+
+	// client <-- destination
+	_, err := copyConn(client, remote)
+	if err != nil || !closeWrite(client) {
+		client.Close()
+	} else {
+		client.SetReadDeadline(time.Now().Add(relayLingerTimeout))
+	}
+
+	<-done
+}
+
+func closeWrite(conn net.Conn) bool {
+	if cw, ok := conn.(closeWriter); ok {
+		return cw.CloseWrite() == nil
+	}
+	return false
+}
+
+// copyConn copies src to dst until EOF. Raw TCP pairs are spliced in the
+// kernel where supported; everything else goes through adaptive buffers.
+func copyConn(dst, src net.Conn) (int64, error) {
+	if n, handled, err := spliceConn(dst, src); handled {
+		return n, err
+	}
+	return copyAdaptive(dst, src)
+}
+
+// copyAdaptive starts with a small buffer, which suits interactive traffic,
+// and moves up a tier whenever a read fills the whole buffer.
+func copyAdaptive(dst io.Writer, src io.Reader) (written int64, err error) {
+	buf := getBuffer(smallBufferSize)
+	defer func() { putBuffer(buf) }()
+
+	for {
+		nr, rerr := src.Read(buf.buf)
+		if nr > 0 {
+			nw, werr := dst.Write(buf.buf[:nr])
+			written += int64(nw)
+			if werr != nil {
+				return written, werr
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+
+			if nr == len(buf.buf) && nr < largeBufferSize {
+				putBuffer(buf)
+				buf = getBuffer(nr + 1)
+			}
+		}
+		if rerr != nil {
+			if rerr == io.EOF || errors.Is(rerr, net.ErrClosed) {
+				return written, nil
+			}
+			return written, rerr
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build linux
+
+package tunnel
+
+import "net"
+
+// spliceConn moves data between two TCP sockets with splice(2), which
+// net.TCPConn.ReadFrom uses on Linux, so payload never enters userspace.
+func spliceConn(dst, src net.Conn) (int64, bool, error) {
+	d, ok := dst.(*net.TCPConn)
+	if !ok {
+		return 0, false, nil
+	}
+	s, ok := src.(*net.TCPConn)
+	if !ok {
+		return 0, false, nil
+	}
+
+	n, err := d.ReadFrom(s)
+	return n, true, err
+}
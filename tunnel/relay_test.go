@@ -0,0 +1,152 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+const relayBenchChunk = 128 * 1024
+
+// plainConn hides the concrete type of a connection, like TLS or WebSocket
+// wrappers do, so neither ReadFrom nor splice can be used.
+type plainConn struct {
+	net.Conn
+}
+
+// legacyRelay is the relay the handlers used before: two io.CopyBuffer calls
+// over 1500 byte buffers.
+func legacyRelay(client, remote net.Conn) {
+	go func() {
+		io.CopyBuffer(struct{ io.Writer }{client}, struct{ io.Reader }{remote}, make([]byte, 1500))
+		client.Close()
+	}()
+
+	io.CopyBuffer(struct{ io.Writer }{remote}, struct{ io.Reader }{client}, make([]byte, 1500))
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s := <-accepted
+	if s == nil {
+		tb.Fatal("accept failed")
+	}
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+func TestRelay(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		wrap func(net.Conn) net.Conn
+		// Without CloseWrite an EOF closes the other side entirely.
+		halfClose bool
+	}{
+		{"tcp", func(c net.Conn) net.Conn { return c }, true},
+		{"wrapped", func(c net.Conn) net.Conn { return plainConn{c} }, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, clientPeer := tcpPair(t)
+			remote, remotePeer := tcpPair(t)
+			defer clientPeer.Close()
+			defer remotePeer.Close()
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				defer clientPeer.Close()
+				defer remotePeer.Close()
+				relay(tc.wrap(clientPeer), tc.wrap(remotePeer))
+			}()
+
+			// Upload, then half-close: the remote must see EOF.
+			payload := make([]byte, 1<<20)
+			for i := range payload {
+				payload[i] = byte(i)
+			}
+			go func() {
+				client.Write(payload)
+				client.CloseWrite()
+			}()
+			got, err := io.ReadAll(remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(payload) {
+				t.Fatalf("remote got %d bytes, want %d", len(got), len(payload))
+			}
+
+			if !tc.halfClose {
+				client.Close()
+				<-done
+				return
+			}
+
+			// The reply still reaches the client after its half-close.
+			if _, err := remote.Write([]byte("reply")); err != nil {
+				t.Fatal(err)
+			}
+			remote.Close()
+			got, err = io.ReadAll(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "reply" {
+				t.Fatalf("client got %q", got)
+			}
+			client.Close()
+			<-done
+		})
+	}
+}
+
+func benchmarkRelay(b *testing.B, relayFunc func(client, remote net.Conn), wrap func(net.Conn) net.Conn) {
+	client, clientPeer := tcpPair(b)
+	remote, remotePeer := tcpPair(b)
+	defer client.Close()
+	defer remote.Close()
+
+	go func() {
+		defer clientPeer.Close()
+		defer remotePeer.Close()
+		relayFunc(wrap(clientPeer), wrap(remotePeer))
+	}()
+
+	go io.Copy(io.Discard, remote)
+
+	chunk := make([]byte, relayBenchChunk)
+	b.SetBytes(relayBenchChunk)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRelayLegacy(b *testing.B) {
+	benchmarkRelay(b, legacyRelay, func(c net.Conn) net.Conn { return c })
+}
+
+func BenchmarkRelaySplice(b *testing.B) {
+	benchmarkRelay(b, relay, func(c net.Conn) net.Conn { return c })
+}
+
+func BenchmarkRelayBuffered(b *testing.B) {
+	benchmarkRelay(b, relay, func(c net.Conn) net.Conn { return plainConn{c} })
+}
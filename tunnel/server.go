@@ -0,0 +1,223 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxHandshakes    = 256
+	DefaultHandshakeTimeout = 10 * time.Second
+)
+
+// ErrServerClosed is returned by Serve after Close has been called.
+var ErrServerClosed = errors.New("tunnel: server closed")
+
+// TrojanServer owns the TLS accept loop and hands every established
+// connection to HandleTrojan.
+type TrojanServer struct {
+	// Addr is the TCP address to listen on, ":443" if empty.
+	Addr string
+
+	// Certs selects the certificate for each handshake. Ignored if
+	// TLSConfig already provides certificates.
+	Certs *CertStore
+
+	// NextProtos is the list of ALPN protocols offered to clients.
+	NextProtos []string
+
+	// TLSConfig is cloned and used as a base configuration. Optional.
+	TLSConfig *tls.Config
+
+	// MaxHandshakes limits concurrent TLS handshakes.
+	// Zero means DefaultMaxHandshakes.
+	MaxHandshakes int
+
+	// HandshakeTimeout bounds each TLS handshake.
+	// Zero means DefaultHandshakeTimeout.
+	HandshakeTimeout time.Duration
+
+	// Handler serves the connection after the handshake.
+	// Nil means HandleTrojan.
+	Handler func(net.Conn)
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	closed    bool
+}
+
+// ListenAndServeTrojan listens on addr and serves Trojan over TLS using the
+// given certificate pair, which is reloaded when the files change.
+func ListenAndServeTrojan(addr, certFile, keyFile string) error {
+	certs, err := NewCertStore(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	srv := &TrojanServer{Addr: addr, Certs: certs}
+	return srv.ListenAndServe()
+}
+
+// ListenAndServe listens on s.Addr and calls Serve.
+func (s *TrojanServer) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":443"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln, performs the TLS handshake and serves
+// each connection in its own goroutine. Serve always closes ln.
+func (s *TrojanServer) Serve(ln net.Listener) error {
+	return s.serve(ln, s.trojanHandler())
+}
+
+// serve is Serve with the connections passed to handler instead of s.Handler.
+func (s *TrojanServer) serve(ln net.Listener, handler func(net.Conn)) error {
+	if !s.trackListener(ln, true) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(ln, false)
+	defer ln.Close()
+
+	config := s.tlsConfig()
+
+	max := s.MaxHandshakes
+	if max <= 0 {
+		max = DefaultMaxHandshakes
+	}
+	handshakes := make(chan struct{}, max)
+
+	var tempDelay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				tempDelay = nextDelay(tempDelay)
+				log.Printf("tunnel: accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+
+		handshakes <- struct{}{}
+		go s.serveConn(tls.Server(conn, config), handshakes, handler)
+	}
+}
+
+// Close stops all listeners passed to Serve. Active connections are not interrupted.
+func (s *TrojanServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+
+	var err error
+	for ln := range s.listeners {
+		if cerr := ln.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (s *TrojanServer) serveConn(tlsConn *tls.Conn, handshakes chan struct{}, handler func(net.Conn)) {
+	err := s.handshake(tlsConn)
+	<-handshakes
+	if err != nil {
+		tlsConn.Close()
+		return
+	}
+
+	defer tlsConn.Close()
+
+	handler(tlsConn)
+}
+
+func (s *TrojanServer) trojanHandler() func(net.Conn) {
+	if s.Handler == nil {
+		return HandleTrojan
+	}
+	return s.Handler
+}
+
+func (s *TrojanServer) handshake(tlsConn *tls.Conn) error {
+	timeout := s.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	return tlsConn.SetDeadline(time.Time{})
+}
+
+func (s *TrojanServer) tlsConfig() *tls.Config {
+	var config *tls.Config
+	if s.TLSConfig != nil {
+		config = s.TLSConfig.Clone()
+	} else {
+		config = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	if s.Certs != nil && len(config.Certificates) == 0 && config.GetCertificate == nil {
+		config.GetCertificate = s.Certs.GetCertificate
+	}
+
+	if len(s.NextProtos) > 0 {
+		config.NextProtos = s.NextProtos
+	}
+
+	return config
+}
+
+func (s *TrojanServer) trackListener(ln net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if add {
+		if s.closed {
+			return false
+		}
+		if s.listeners == nil {
+			s.listeners = make(map[net.Listener]struct{})
+		}
+		s.listeners[ln] = struct{}{}
+	} else {
+		delete(s.listeners, ln)
+	}
+	return true
+}
+
+func (s *TrojanServer) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func nextDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	delay *= 2
+	if max := time.Second; delay > max {
+		delay = max
+	}
+	return delay
+}
@@ -0,0 +1,583 @@
+package tunnel
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+/*
+Shadowsocks AEAD TCP stream:
+
++--------+------------------------+-------------------------+-----+
+|  Salt  | encrypted length + tag | encrypted payload + tag | ... |
++--------+------------------------+-------------------------+-----+
+| keylen |         2 + 16         |   Variable (<= 0x3FFF)  |     |
++--------+------------------------+-------------------------+-----+
+
+the first payload starts with the SOCKS target address.
+
+each UDP packet has the following format:
+
++--------+------------------------------------------+
+|  Salt  | encrypted (SOCKS addr + payload) + tag   |
++--------+------------------------------------------+
+| keylen |                 Variable                 |
++--------+------------------------------------------+
+*/
+
+const (
+	ssMaxPayload      = 0x3FFF
+	ssSaltFilterLimit = 1 << 16
+	ssUDPQueueSize    = 64
+)
+
+var (
+	ErrUnknownMethod = errors.New("shadowsocks: unknown method")
+	errSaltReplay    = errors.New("shadowsocks: repeated salt")
+
+	ssSubkeyInfo = []byte("ss-subkey")
+)
+
+// ssUDPUser is the name the UDP sessions of a Shadowsocks client are
+// accounted to. Clients share the password, so they are told apart by IP.
+func ssUDPUser(clientAddr net.Addr) string {
+	host, _, err := net.SplitHostPort(clientAddr.String())
+	if err != nil {
+		host = clientAddr.String()
+	}
+	return "shadowsocks/" + host
+}
+
+type ssCipher struct {
+	key     []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+	salts   *saltFilter
+}
+
+func newSSCipher(method, password string) (*ssCipher, error) {
+	c := &ssCipher{salts: newSaltFilter(ssSaltFilterLimit)}
+
+	switch strings.ToLower(method) {
+	case "aes-128-gcm":
+		c.key = evpBytesToKey(password, 16)
+		c.newAEAD = newGCM
+	case "aes-256-gcm":
+		c.key = evpBytesToKey(password, 32)
+		c.newAEAD = newGCM
+	case "chacha20-ietf-poly1305":
+		c.key = evpBytesToKey(password, chacha20poly1305.KeySize)
+		c.newAEAD = chacha20poly1305.New
+	default:
+		return nil, ErrUnknownMethod
+	}
+	return c, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (c *ssCipher) saltSize() int {
+	return len(c.key)
+}
+
+func (c *ssCipher) subkeyAEAD(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, len(c.key))
+	if _, err := io.ReadFull(hkdf.New(sha1.New, c.key, salt, ssSubkeyInfo), subkey); err != nil {
+		return nil, err
+	}
+	return c.newAEAD(subkey)
+}
+
+// unpack decrypts a UDP packet in place and returns the plaintext.
+func (c *ssCipher) unpack(pkt []byte) ([]byte, error) {
+	saltSize := c.saltSize()
+	if len(pkt) < saltSize {
+		return nil, io.ErrShortBuffer
+	}
+
+	aead, err := c.subkeyAEAD(pkt[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	if len(pkt) < saltSize+aead.Overhead() {
+		return nil, io.ErrShortBuffer
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	return aead.Open(pkt[saltSize:saltSize], nonce, pkt[saltSize:], nil)
+}
+
+// pack appends the encrypted UDP packet for plaintext to dst.
+func (c *ssCipher) pack(dst, plaintext []byte) ([]byte, error) {
+	salt := make([]byte, c.saltSize())
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := c.subkeyAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	dst = append(dst, salt...)
+	return aead.Seal(dst, nonce, plaintext, nil), nil
+}
+
+// evpBytesToKey is OpenSSL's EVP_BytesToKey with MD5 and no salt.
+func evpBytesToKey(password string, keyLen int) []byte {
+	var key, prev []byte
+	h := md5.New()
+	for len(key) < keyLen {
+		h.Reset()
+		h.Write(prev)
+		h.Write([]byte(password))
+		key = h.Sum(key)
+		prev = key[len(key)-h.Size():]
+	}
+	return key[:keyLen]
+}
+
+func incNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// saltFilter remembers recently seen salts in two generations to reject replays.
+type saltFilter struct {
+	mu    sync.Mutex
+	limit int
+	cur   map[string]struct{}
+	prev  map[string]struct{}
+}
+
+func newSaltFilter(limit int) *saltFilter {
+	return &saltFilter{limit: limit, cur: make(map[string]struct{})}
+}
+
+// add records salt and reports whether it had not been seen before.
+func (f *saltFilter) add(salt []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := string(salt)
+	if _, ok := f.cur[key]; ok {
+		return false
+	}
+	if _, ok := f.prev[key]; ok {
+		return false
+	}
+
+	if len(f.cur) >= f.limit {
+		f.prev = f.cur
+		f.cur = make(map[string]struct{})
+	}
+	f.cur[key] = struct{}{}
+	return true
+}
+
+// ssConn encrypts and decrypts a Shadowsocks AEAD TCP stream.
+type ssConn struct {
+	net.Conn
+	cipher *ssCipher
+
+	reader  cipher.AEAD
+	rNonce  []byte
+	rBuf    []byte
+	pending []byte
+
+	writeMu sync.Mutex
+	writer  cipher.AEAD
+	wNonce  []byte
+	wBuf    []byte
+}
+
+func newSSConn(conn net.Conn, c *ssCipher) *ssConn {
+	return &ssConn{Conn: conn, cipher: c}
+}
+
+func (c *ssConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		if err := c.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *ssConn) readChunk() error {
+	var salt []byte
+	if c.reader == nil {
+		salt = make([]byte, c.cipher.saltSize())
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return err
+		}
+
+		aead, err := c.cipher.subkeyAEAD(salt)
+		if err != nil {
+			return err
+		}
+
+		c.reader = aead
+		c.rNonce = make([]byte, aead.NonceSize())
+		c.rBuf = make([]byte, 2+aead.Overhead()+ssMaxPayload+aead.Overhead())
+	}
+
+	overhead := c.reader.Overhead()
+
+	lenBuf := c.rBuf[:2+overhead]
+	if _, err := io.ReadFull(c.Conn, lenBuf); err != nil {
+		return err
+	}
+	if _, err := c.reader.Open(lenBuf[:0], c.rNonce, lenBuf, nil); err != nil {
+		return err
+	}
+	incNonce(c.rNonce)
+
+	size := (int(lenBuf[0])<<8 | int(lenBuf[1])) & ssMaxPayload
+
+	payload := c.rBuf[2+overhead : 2+overhead+size+overhead]
+	if _, err := io.ReadFull(c.Conn, payload); err != nil {
+		return err
+	}
+	plain, err := c.reader.Open(payload[:0], c.rNonce, payload, nil)
+	if err != nil {
+		return err
+	}
+	incNonce(c.rNonce)
+
+	// The salt is recorded only once the first chunk authenticates, so
+	// random probes can't fill the filter.
+	if salt != nil && !c.cipher.salts.add(salt) {
+		return errSaltReplay
+	}
+
+	c.pending = plain
+	return nil
+}
+
+func (c *ssConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.wBuf = c.wBuf[:0]
+	if c.writer == nil {
+		salt := make([]byte, c.cipher.saltSize())
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+
+		aead, err := c.cipher.subkeyAEAD(salt)
+		if err != nil {
+			return 0, err
+		}
+
+		c.writer = aead
+		c.wNonce = make([]byte, aead.NonceSize())
+		c.wBuf = append(c.wBuf, salt...)
+	}
+
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if len(chunk) > ssMaxPayload {
+			chunk = chunk[:ssMaxPayload]
+		}
+
+		c.wBuf = c.writer.Seal(c.wBuf, c.wNonce, []byte{byte(len(chunk) >> 8), byte(len(chunk))}, nil)
+		incNonce(c.wNonce)
+		c.wBuf = c.writer.Seal(c.wBuf, c.wNonce, chunk, nil)
+		incNonce(c.wNonce)
+
+		if _, err := c.Conn.Write(c.wBuf); err != nil {
+			return written, err
+		}
+		c.wBuf = c.wBuf[:0]
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// ShadowsocksServer is a Shadowsocks AEAD inbound serving TCP and UDP. The
+// UDP sessions of each client IP count against MaxUDPSessionsPerUser of the
+// Egress.
+type ShadowsocksServer struct {
+	// Addr is the address to listen on for both TCP and UDP.
+	Addr string
+
+	// Egress dials destinations. Nil means DefaultEgress.
+	Egress *Egress
+
+	// UDPIdleTimeout closes UDP sessions without traffic in either
+	// direction. Zero means the Egress setting.
+	UDPIdleTimeout time.Duration
+
+	cipher *ssCipher
+
+	mu      sync.Mutex
+	closers []io.Closer
+	closed  bool
+}
+
+// NewShadowsocksServer returns a server for method, one of aes-128-gcm,
+// aes-256-gcm or chacha20-ietf-poly1305.
+func NewShadowsocksServer(addr, method, password string) (*ShadowsocksServer, error) {
+	c, err := newSSCipher(method, password)
+	if err != nil {
+		return nil, err
+	}
+	return &ShadowsocksServer{Addr: addr, cipher: c}, nil
+}
+
+// ListenAndServe serves TCP and UDP on s.Addr until one of them fails.
+func (s *ShadowsocksServer) ListenAndServe() error {
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+
+	pc, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+
+	errc := make(chan error, 2)
+	go func() { errc <- s.Serve(ln) }()
+	go func() { errc <- s.ServePacket(pc) }()
+
+	err = <-errc
+	s.Close()
+	return err
+}
+
+// Serve accepts Shadowsocks TCP connections on ln.
+func (s *ShadowsocksServer) Serve(ln net.Listener) error {
+	if !s.track(ln) {
+		return ErrServerClosed
+	}
+	defer ln.Close()
+
+	var tempDelay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				tempDelay = nextDelay(tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a single Shadowsocks TCP connection and closes it.
+func (s *ShadowsocksServer) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	ss := newSSConn(conn, s.cipher)
+
+	connData := getBuffer(smallBufferSize)
+	defer putBuffer(connData)
+
+	conn.SetReadDeadline(time.Now().Add(DefaultHandshakeTimeout))
+	addr, err := ReadAddr(ss, connData.buf)
+	if err != nil {
+		// Don't give active probes a distinguishable response.
+		io.Copy(io.Discard, conn)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	addr = append(Addr(nil), addr...)
+
+	remote, err := s.egress().Dial("tcp", addr)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer remote.Close()
+
+	relay(ss, remote)
+}
+
+// ServePacket relays Shadowsocks UDP packets received on pc. Each client
+// session sends from its own goroutine, so resolving a destination for one
+// client doesn't hold up the others.
+func (s *ShadowsocksServer) ServePacket(pc net.PacketConn) error {
+	if !s.track(pc) {
+		return ErrServerClosed
+	}
+	defer pc.Close()
+
+	var (
+		mu       sync.Mutex
+		sessions = make(map[string]chan ssUDPPacket)
+	)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, clientAddr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		plain, err := s.cipher.unpack(buf[:n])
+		if err != nil {
+			continue
+		}
+		// Replayed packets are dropped like replayed streams, salts are
+		// recorded once the packet authenticates.
+		if !s.cipher.salts.add(buf[:s.cipher.saltSize()]) {
+			continue
+		}
+
+		addr := SplitAddr(plain)
+		if addr == nil || !s.egress().AllowUDP(addr) {
+			continue
+		}
+
+		key := clientAddr.String()
+		mu.Lock()
+		queue := sessions[key]
+		if queue == nil {
+			session, err := s.egress().listenUDPSession(ssUDPUser(clientAddr))
+			if err != nil {
+				mu.Unlock()
+				continue
+			}
+			if s.UDPIdleTimeout > 0 {
+				session.idle = s.UDPIdleTimeout
+			}
+			queue = make(chan ssUDPPacket, ssUDPQueueSize)
+			sessions[key] = queue
+
+			go s.udpRequests(session, queue)
+			go func() {
+				s.udpReplies(pc, clientAddr, session)
+				mu.Lock()
+				delete(sessions, key)
+				close(queue)
+				mu.Unlock()
+			}()
+		}
+
+		// Like any UDP hop, drop packets rather than wait for a slow session.
+		select {
+		case queue <- ssUDPPacket{addr: append(Addr(nil), addr...), payload: append([]byte(nil), plain[len(addr):]...)}:
+		default:
+		}
+		mu.Unlock()
+	}
+}
+
+// ssUDPPacket is a client packet waiting to be sent to addr.
+type ssUDPPacket struct {
+	addr    Addr
+	payload []byte
+}
+
+func (s *ShadowsocksServer) udpRequests(session *udpSession, queue <-chan ssUDPPacket) {
+	for pkt := range queue {
+		if err := session.WriteTo(pkt.payload, pkt.addr); err != nil {
+			// Ends udpReplies, which closes the queue.
+			session.Close()
+		}
+	}
+}
+
+func (s *ShadowsocksServer) udpReplies(pc net.PacketConn, clientAddr net.Addr, session *udpSession) {
+	defer session.Close()
+
+	payload := make([]byte, 64*1024)
+	var plain, packet []byte
+	for {
+		n, from, err := session.ReadFrom(payload)
+		if err != nil {
+			return
+		}
+
+		plain = append(append(plain[:0], from...), payload[:n]...)
+		packet, err = s.cipher.pack(packet[:0], plain)
+		if err != nil {
+			return
+		}
+		if _, err := pc.WriteTo(packet, clientAddr); err != nil {
+			return
+		}
+	}
+}
+
+// Close stops all listeners and packet connections served by s.
+func (s *ShadowsocksServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for _, c := range s.closers {
+		c.Close()
+	}
+	s.closers = nil
+	return nil
+}
+
+func (s *ShadowsocksServer) track(c io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		c.Close()
+		return false
+	}
+	s.closers = append(s.closers, c)
+	return true
+}
+
+func (s *ShadowsocksServer) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *ShadowsocksServer) egress() *Egress {
+	if s.Egress != nil {
+		return s.Egress
+	}
+	return DefaultEgress
+}
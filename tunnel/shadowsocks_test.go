@@ -0,0 +1,316 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// The vectors below were produced with an independent implementation of
+// ChaCha20-Poly1305 (checked against RFC 8439), HMAC-SHA1 HKDF and
+// EVP_BytesToKey, the keys cross-checked with the openssl command line tool.
+// The password is "password" and the salt the bytes 0 to 31.
+const (
+	// ssTCPVector is a chacha20-ietf-poly1305 stream carrying example.com:80
+	// and "GET / HTTP/1.1\r\n\r\n" in the first chunk and "hello" in the second.
+	ssTCPVector = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f" +
+		"ad69f94d8c5e4f6a2014d4dd503a61e01ece83c3ce5d825d5be9428b2bc98d01eea45c7fb1da8193ac2b754a32" +
+		"2024f98b72d1bb7e3a16e9c9635d8bcf2c8ac747af84ef962715abb8903234d772356c9e91ccfcc8cffc36e25b" +
+		"eb1e6e46997d2c5e420dc8531c72b4c3"
+
+	// ssUDPVector is a chacha20-ietf-poly1305 packet for example.com:80 carrying "ping".
+	ssUDPVector = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f" +
+		"ae43eb899fd70234f3c8006c9c9528fb4e328dce7bdb60073073bb3c2dc60df25bfa25"
+)
+
+var ssMethods = []string{"aes-128-gcm", "aes-256-gcm", "chacha20-ietf-poly1305"}
+
+func mustHex(tb testing.TB, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return b
+}
+
+func newTestSSCipher(tb testing.TB, method string) *ssCipher {
+	c, err := newSSCipher(method, "password")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return c
+}
+
+// ssServerConn returns an ssConn reading data as sent by a client.
+func ssServerConn(c *ssCipher, data []byte) *ssConn {
+	client, server := net.Pipe()
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	return newSSConn(server, c)
+}
+
+func TestEVPBytesToKey(t *testing.T) {
+	for keyLen, want := range map[int]string{
+		16: "5f4dcc3b5aa765d61d8327deb882cf99",
+		32: "5f4dcc3b5aa765d61d8327deb882cf992b95990a9151374abd8ff8c5a7a0fe08",
+	} {
+		if got := hex.EncodeToString(evpBytesToKey("password", keyLen)); got != want {
+			t.Errorf("%d byte key = %s, want %s", keyLen, got, want)
+		}
+	}
+}
+
+func TestShadowsocksTCPVector(t *testing.T) {
+	conn := ssServerConn(newTestSSCipher(t, "chacha20-ietf-poly1305"), mustHex(t, ssTCPVector))
+
+	addr, err := ReadAddr(conn, make([]byte, smallBufferSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "example.com:80" {
+		t.Fatalf("address %s", addr)
+	}
+	rest, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "GET / HTTP/1.1\r\n\r\nhello" {
+		t.Fatalf("payload %q", rest)
+	}
+}
+
+func TestShadowsocksUDPVector(t *testing.T) {
+	c := newTestSSCipher(t, "chacha20-ietf-poly1305")
+
+	plain, err := c.unpack(mustHex(t, ssUDPVector))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := SplitAddr(plain)
+	if addr == nil || addr.String() != "example.com:80" || string(plain[len(addr):]) != "ping" {
+		t.Fatalf("packet %q", plain)
+	}
+}
+
+func TestShadowsocksRoundTrip(t *testing.T) {
+	// Several chunks, the last one partial.
+	data := make([]byte, 2*ssMaxPayload+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	for _, method := range ssMethods {
+		c := newTestSSCipher(t, method)
+
+		client, server := net.Pipe()
+		go func() {
+			newSSConn(client, c).Write(data)
+			client.Close()
+		}()
+		got, err := io.ReadAll(newSSConn(server, c))
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%s: got %d bytes back, sent %d", method, len(got), len(data))
+		}
+
+		packet, err := c.pack(nil, []byte("packet"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := c.unpack(packet)
+		if err != nil || string(plain) != "packet" {
+			t.Fatalf("%s: unpack = %q, %v", method, plain, err)
+		}
+	}
+}
+
+func TestShadowsocksSaltReplay(t *testing.T) {
+	c := newTestSSCipher(t, "chacha20-ietf-poly1305")
+	stream := mustHex(t, ssTCPVector)
+
+	if _, err := io.ReadAll(ssServerConn(c, stream)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(ssServerConn(c, stream)); !errors.Is(err, errSaltReplay) {
+		t.Fatalf("replayed stream: %v", err)
+	}
+
+	// Another server, e.g. after a restart, has not seen the salt.
+	if _, err := io.ReadAll(ssServerConn(newTestSSCipher(t, "chacha20-ietf-poly1305"), stream)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShadowsocksBadTag(t *testing.T) {
+	const saltSize = 32
+
+	for name, offset := range map[string]int{
+		"salt":           0,
+		"length":         saltSize,
+		"length tag":     saltSize + 2,
+		"payload":        saltSize + 2 + 16,
+		"second payload": len(ssTCPVector)/2 - 1,
+	} {
+		stream := mustHex(t, ssTCPVector)
+		stream[offset] ^= 1
+
+		if _, err := io.ReadAll(ssServerConn(newTestSSCipher(t, "chacha20-ietf-poly1305"), stream)); err == nil {
+			t.Errorf("%s: corrupted stream accepted", name)
+		}
+	}
+
+	// A stream failing its first chunk does not burn the salt.
+	c := newTestSSCipher(t, "chacha20-ietf-poly1305")
+	stream := mustHex(t, ssTCPVector)
+	stream[saltSize+2] ^= 1
+	if _, err := io.ReadAll(ssServerConn(c, stream)); err == nil {
+		t.Fatal("corrupted stream accepted")
+	}
+	if _, err := io.ReadAll(ssServerConn(c, mustHex(t, ssTCPVector))); err != nil {
+		t.Fatal(err)
+	}
+
+	packet := mustHex(t, ssUDPVector)
+	packet[len(packet)-1] ^= 1
+	if _, err := c.unpack(packet); err == nil {
+		t.Fatal("corrupted packet accepted")
+	}
+	if _, err := c.unpack(packet[:40]); err == nil {
+		t.Fatal("truncated packet accepted")
+	}
+}
+
+// ssExchange sends payload to target through the Shadowsocks UDP server at
+// server from a socket bound to ip and returns the reply, or nil if none
+// arrives within timeout.
+func ssExchange(t *testing.T, c *ssCipher, ip net.IP, server, target net.Addr, payload string, timeout time.Duration) []byte {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	packet, err := c.pack(nil, append(ParseAddr(target.String()), payload...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo(packet, server); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, largeBufferSize)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil
+	}
+	plain, err := c.unpack(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plain[len(SplitAddr(plain)):]
+}
+
+func TestShadowsocksUDPSessionsPerClient(t *testing.T) {
+	echo := udpEchoServer(t)
+	defer echo.Close()
+
+	egress := &Egress{MaxUDPSessionsPerUser: 1}
+	srv, err := NewShadowsocksServer("", "chacha20-ietf-poly1305", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Egress = egress
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServePacket(pc)
+	defer srv.Close()
+
+	c := newTestSSCipher(t, "chacha20-ietf-poly1305")
+
+	// The first client uses up the slot of its IP, the session outliving
+	// the socket until it idles out...
+	if got := ssExchange(t, c, net.IPv4(127, 0, 0, 1), pc.LocalAddr(), echo.LocalAddr(), "first", 5*time.Second); string(got) != "first" {
+		t.Fatalf("first client got %q", got)
+	}
+
+	// ...but neither other clients nor other users.
+	if got := ssExchange(t, c, net.IPv4(127, 0, 0, 2), pc.LocalAddr(), echo.LocalAddr(), "second", 5*time.Second); string(got) != "second" {
+		t.Fatalf("client on another IP got %q", got)
+	}
+	session, err := egress.listenUDPSession("test")
+	if err != nil {
+		t.Fatalf("other user: %v", err)
+	}
+	session.Close()
+
+	// A second socket of the first IP is over the limit.
+	if got := ssExchange(t, c, net.IPv4(127, 0, 0, 1), pc.LocalAddr(), echo.LocalAddr(), "third", 200*time.Millisecond); got != nil {
+		t.Fatalf("second session of the same IP got %q", got)
+	}
+}
+
+func TestShadowsocksUDPSaltReplay(t *testing.T) {
+	echo := udpEchoServer(t)
+	defer echo.Close()
+
+	srv, err := NewShadowsocksServer("", "chacha20-ietf-poly1305", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Egress = &Egress{}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServePacket(pc)
+	defer srv.Close()
+
+	conn := udpPeer(t, net.IPv4(127, 0, 0, 1))
+	c := newTestSSCipher(t, "chacha20-ietf-poly1305")
+	pack := func(payload string) []byte {
+		packet, err := c.pack(nil, append(ParseAddr(echo.LocalAddr().String()), payload...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return packet
+	}
+	read := func() string {
+		buf := make([]byte, largeBufferSize)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := c.unpack(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(plain[len(SplitAddr(plain)):])
+	}
+
+	first := pack("first")
+	conn.WriteTo(first, pc.LocalAddr())
+	if got := read(); got != "first" {
+		t.Fatalf("got %q", got)
+	}
+
+	// The replay is dropped, so the next packet's reply comes first.
+	conn.WriteTo(first, pc.LocalAddr())
+	conn.WriteTo(pack("second"), pc.LocalAddr())
+	if got := read(); got != "second" {
+		t.Fatalf("got %q, want the reply to the second packet", got)
+	}
+}
@@ -0,0 +1,333 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+smux v1 frame, as used by Trojan-Go multiplexing (CMD 0x7f):
+
++-----+-----+--------+----------+----------+
+| VER | CMD | LENGTH | STREAMID |   DATA   |
++-----+-----+--------+----------+----------+
+|  1  |  1  |   2    |    4     | Variable |
++-----+-----+--------+----------+----------+
+
+LENGTH and STREAMID are little-endian. Each stream starts with a
+simplesocks request, a CMD byte followed by a SOCKS address.
+
+v1 has no window updates: flow control is the session's receive buffer,
+once it is full the connection is not read until the streams drain it.
+*/
+
+const (
+	smuxVersion = 1
+
+	smuxCmdSYN = 0
+	smuxCmdFIN = 1
+	smuxCmdPSH = 2
+	smuxCmdNOP = 3
+
+	smuxHeaderSize       = 8
+	smuxMaxFrameSize     = 32768
+	smuxMaxReceiveBuffer = 4 * 1024 * 1024
+	smuxKeepAliveTimeout = 30 * time.Second
+)
+
+var errMuxClosed = errors.New("mux session closed")
+
+type muxSession struct {
+	conn net.Conn
+
+	writeMu  sync.Mutex
+	writeBuf []byte
+
+	mu       sync.Mutex
+	bufCond  *sync.Cond
+	buffered int
+	streams  map[uint32]*muxStream
+	dead     bool
+
+	accept chan *muxStream
+	die    chan struct{}
+}
+
+func newMuxSession(conn net.Conn) *muxSession {
+	s := &muxSession{
+		conn:     conn,
+		writeBuf: make([]byte, smuxHeaderSize+smuxMaxFrameSize),
+		streams:  make(map[uint32]*muxStream),
+		accept:   make(chan *muxStream, 64),
+		die:      make(chan struct{}),
+	}
+	s.bufCond = sync.NewCond(&s.mu)
+
+	go s.recvLoop()
+	return s
+}
+
+// Accept returns the next stream opened by the client.
+func (s *muxSession) Accept() (*muxStream, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.die:
+		return nil, errMuxClosed
+	}
+}
+
+func (s *muxSession) recvLoop() {
+	defer s.close()
+
+	header := make([]byte, smuxHeaderSize)
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(smuxKeepAliveTimeout))
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			return
+		}
+
+		if header[0] != smuxVersion {
+			return
+		}
+		cmd := header[1]
+		length := int(binary.LittleEndian.Uint16(header[2:]))
+		sid := binary.LittleEndian.Uint32(header[4:])
+
+		switch cmd {
+		case smuxCmdNOP:
+		case smuxCmdSYN:
+			s.mu.Lock()
+			if _, ok := s.streams[sid]; ok {
+				s.mu.Unlock()
+				continue
+			}
+			stream := newMuxStream(sid, s)
+			s.streams[sid] = stream
+			s.mu.Unlock()
+
+			select {
+			case s.accept <- stream:
+			case <-s.die:
+				return
+			}
+		case smuxCmdFIN:
+			s.mu.Lock()
+			stream := s.streams[sid]
+			s.mu.Unlock()
+			if stream != nil {
+				stream.finish()
+			}
+		case smuxCmdPSH:
+			if length == 0 {
+				continue
+			}
+
+			data := make([]byte, length)
+			if _, err := io.ReadFull(s.conn, data); err != nil {
+				return
+			}
+
+			s.mu.Lock()
+			stream := s.streams[sid]
+			if stream != nil {
+				s.buffered += length
+			}
+			s.mu.Unlock()
+
+			if stream != nil {
+				stream.push(data)
+			}
+
+			// Stop reading until the streams have drained some data.
+			s.mu.Lock()
+			for s.buffered > smuxMaxReceiveBuffer && !s.dead {
+				s.bufCond.Wait()
+			}
+			s.mu.Unlock()
+		default:
+			return
+		}
+	}
+}
+
+func (s *muxSession) release(n int) {
+	s.mu.Lock()
+	s.buffered -= n
+	s.mu.Unlock()
+	s.bufCond.Signal()
+}
+
+func (s *muxSession) writeFrame(cmd byte, sid uint32, data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	frame := s.writeBuf[:smuxHeaderSize+len(data)]
+	frame[0] = smuxVersion
+	frame[1] = cmd
+	binary.LittleEndian.PutUint16(frame[2:], uint16(len(data)))
+	binary.LittleEndian.PutUint32(frame[4:], sid)
+	copy(frame[smuxHeaderSize:], data)
+
+	_, err := s.conn.Write(frame)
+	return err
+}
+
+func (s *muxSession) removeStream(sid uint32) {
+	s.mu.Lock()
+	delete(s.streams, sid)
+	s.mu.Unlock()
+}
+
+func (s *muxSession) close() {
+	s.mu.Lock()
+	if s.dead {
+		s.mu.Unlock()
+		return
+	}
+	s.dead = true
+	streams := s.streams
+	s.streams = make(map[uint32]*muxStream)
+	s.mu.Unlock()
+
+	close(s.die)
+	s.bufCond.Broadcast()
+	s.conn.Close()
+
+	for _, stream := range streams {
+		stream.sessionClosed()
+	}
+}
+
+// muxStream is one smux stream. Deadlines are not supported.
+type muxStream struct {
+	id   uint32
+	sess *muxSession
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      [][]byte
+	fin      bool
+	closed   bool
+	sessDead bool
+
+	closeOnce sync.Once
+}
+
+func newMuxStream(id uint32, sess *muxSession) *muxStream {
+	stream := &muxStream{id: id, sess: sess}
+	stream.cond = sync.NewCond(&stream.mu)
+	return stream
+}
+
+func (m *muxStream) push(data []byte) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		m.sess.release(len(data))
+		return
+	}
+	m.buf = append(m.buf, data)
+	m.mu.Unlock()
+	m.cond.Signal()
+}
+
+func (m *muxStream) finish() {
+	m.mu.Lock()
+	m.fin = true
+	m.mu.Unlock()
+	m.cond.Broadcast()
+}
+
+func (m *muxStream) sessionClosed() {
+	m.mu.Lock()
+	m.sessDead = true
+	m.mu.Unlock()
+	m.cond.Broadcast()
+}
+
+func (m *muxStream) Read(b []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for len(m.buf) == 0 {
+		switch {
+		case m.closed:
+			return 0, io.ErrClosedPipe
+		case m.fin:
+			return 0, io.EOF
+		case m.sessDead:
+			return 0, errMuxClosed
+		}
+		m.cond.Wait()
+	}
+
+	n := copy(b, m.buf[0])
+	if n == len(m.buf[0]) {
+		m.buf[0] = nil
+		m.buf = m.buf[1:]
+	} else {
+		m.buf[0] = m.buf[0][n:]
+	}
+
+	m.sess.release(n)
+	return n, nil
+}
+
+func (m *muxStream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		m.mu.Lock()
+		closed := m.closed || m.sessDead
+		m.mu.Unlock()
+		if closed {
+			return written, io.ErrClosedPipe
+		}
+
+		chunk := b[written:]
+		if len(chunk) > smuxMaxFrameSize {
+			chunk = chunk[:smuxMaxFrameSize]
+		}
+		if err := m.sess.writeFrame(smuxCmdPSH, m.id, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+func (m *muxStream) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		m.mu.Lock()
+		m.closed = true
+		unread := 0
+		for _, b := range m.buf {
+			unread += len(b)
+		}
+		m.buf = nil
+		m.mu.Unlock()
+		m.cond.Broadcast()
+
+		m.sess.release(unread)
+		m.sess.removeStream(m.id)
+		err = m.sess.writeFrame(smuxCmdFIN, m.id, nil)
+	})
+	return err
+}
+
+func (m *muxStream) LocalAddr() net.Addr {
+	return m.sess.conn.LocalAddr()
+}
+
+func (m *muxStream) RemoteAddr() net.Addr {
+	return m.sess.conn.RemoteAddr()
+}
+
+func (m *muxStream) SetDeadline(t time.Time) error      { return nil }
+func (m *muxStream) SetReadDeadline(t time.Time) error  { return nil }
+func (m *muxStream) SetWriteDeadline(t time.Time) error { return nil }
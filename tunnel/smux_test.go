@@ -0,0 +1,284 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func smuxFrame(cmd byte, sid uint32, data []byte) []byte {
+	frame := make([]byte, smuxHeaderSize, smuxHeaderSize+len(data))
+	frame[0] = smuxVersion
+	frame[1] = cmd
+	binary.LittleEndian.PutUint16(frame[2:], uint16(len(data)))
+	binary.LittleEndian.PutUint32(frame[4:], sid)
+	return append(frame, data...)
+}
+
+func readSmuxFrame(tb testing.TB, r io.Reader) (byte, uint32, []byte) {
+	header := make([]byte, smuxHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		tb.Fatal(err)
+	}
+	if header[0] != smuxVersion {
+		tb.Fatalf("version %d", header[0])
+	}
+	data := make([]byte, binary.LittleEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		tb.Fatal(err)
+	}
+	return header[1], binary.LittleEndian.Uint32(header[4:]), data
+}
+
+// startMuxSession serves a session on one end of a TCP connection and
+// returns the client end.
+func startMuxSession(t *testing.T) (*muxSession, net.Conn) {
+	client, server := tcpPair(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { client.Close() })
+	return newMuxSession(server), client
+}
+
+func acceptStream(t *testing.T, s *muxSession) *muxStream {
+	accepted := make(chan *muxStream, 1)
+	go func() {
+		stream, _ := s.Accept()
+		accepted <- stream
+	}()
+	select {
+	case stream := <-accepted:
+		if stream == nil {
+			t.Fatal("session closed")
+		}
+		return stream
+	case <-time.After(5 * time.Second):
+		t.Fatal("no stream accepted")
+		return nil
+	}
+}
+
+func TestSmuxFraming(t *testing.T) {
+	s, client := startMuxSession(t)
+
+	client.Write(smuxFrame(smuxCmdSYN, 3, nil))
+	stream := acceptStream(t, s)
+	if stream.id != 3 {
+		t.Fatalf("stream id %d", stream.id)
+	}
+
+	// Data of several PSH frames, with NOPs and empty frames between them,
+	// reads as one stream.
+	client.Write(smuxFrame(smuxCmdPSH, 3, []byte("hel")))
+	client.Write(smuxFrame(smuxCmdNOP, 0, nil))
+	client.Write(smuxFrame(smuxCmdPSH, 3, nil))
+	client.Write(smuxFrame(smuxCmdPSH, 3, []byte("lo")))
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(stream, got); err != nil || string(got) != "hello" {
+		t.Fatalf("read %q, %v", got, err)
+	}
+
+	// Writes go out as PSH frames of at most smuxMaxFrameSize bytes.
+	data := bytes.Repeat([]byte("x"), smuxMaxFrameSize+10)
+	go stream.Write(data)
+	for _, size := range []int{smuxMaxFrameSize, 10} {
+		cmd, sid, payload := readSmuxFrame(t, client)
+		if cmd != smuxCmdPSH || sid != 3 || len(payload) != size {
+			t.Fatalf("frame cmd %d, stream %d, %d bytes", cmd, sid, len(payload))
+		}
+	}
+
+	// FIN from the client ends reading, the stream can still write.
+	client.Write(smuxFrame(smuxCmdFIN, 3, nil))
+	if n, err := stream.Read(got); n != 0 || err != io.EOF {
+		t.Fatalf("read after FIN: %d, %v", n, err)
+	}
+	if _, err := stream.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	if cmd, _, payload := readSmuxFrame(t, client); cmd != smuxCmdPSH || string(payload) != "bye" {
+		t.Fatalf("frame cmd %d, %q", cmd, payload)
+	}
+
+	// Closing sends FIN and forgets the stream.
+	stream.Close()
+	if cmd, sid, _ := readSmuxFrame(t, client); cmd != smuxCmdFIN || sid != 3 {
+		t.Fatalf("frame cmd %d, stream %d", cmd, sid)
+	}
+	if _, err := stream.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Fatalf("write after close: %v", err)
+	}
+	s.mu.Lock()
+	n := len(s.streams)
+	s.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d streams left", n)
+	}
+}
+
+func TestSmuxStreams(t *testing.T) {
+	s, client := startMuxSession(t)
+
+	client.Write(smuxFrame(smuxCmdSYN, 1, nil))
+	first := acceptStream(t, s)
+	// A repeated SYN doesn't replace the stream.
+	client.Write(smuxFrame(smuxCmdSYN, 1, nil))
+	client.Write(smuxFrame(smuxCmdSYN, 2, nil))
+	second := acceptStream(t, s)
+	if second.id != 2 {
+		t.Fatalf("accepted stream %d", second.id)
+	}
+
+	// Data for unknown streams is dropped, the others are not mixed up.
+	client.Write(smuxFrame(smuxCmdPSH, 9, []byte("lost")))
+	client.Write(smuxFrame(smuxCmdPSH, 2, []byte("two")))
+	client.Write(smuxFrame(smuxCmdPSH, 1, []byte("one")))
+	for stream, want := range map[*muxStream]string{first: "one", second: "two"} {
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(stream, got); err != nil || string(got) != want {
+			t.Fatalf("stream %d read %q, %v", stream.id, got, err)
+		}
+	}
+}
+
+func TestSmuxSessionClose(t *testing.T) {
+	for name, end := range map[string][]byte{
+		"connection closed": nil,
+		"bad version":       {2, smuxCmdNOP, 0, 0, 0, 0, 0, 0},
+		// UPD, the window update of smux v2.
+		"unknown command": smuxFrame(4, 1, nil),
+	} {
+		s, client := startMuxSession(t)
+		client.Write(smuxFrame(smuxCmdSYN, 1, nil))
+		stream := acceptStream(t, s)
+
+		if end == nil {
+			client.Close()
+		} else {
+			client.Write(end)
+		}
+
+		// Blocked readers, writers and Accept are all released.
+		if _, err := stream.Read(make([]byte, 1)); err != errMuxClosed {
+			t.Errorf("%s: read %v", name, err)
+		}
+		if _, err := stream.Write([]byte("x")); err == nil {
+			t.Errorf("%s: write succeeded", name)
+		}
+		if _, err := s.Accept(); err != errMuxClosed {
+			t.Errorf("%s: accept %v", name, err)
+		}
+		stream.Close()
+	}
+}
+
+func TestSmuxReceiveBuffer(t *testing.T) {
+	// A pipe has no buffer of its own: a write returns once the session has
+	// read the whole frame, and times out while the session isn't reading.
+	client, server := net.Pipe()
+	defer client.Close()
+	s := newMuxSession(server)
+	go io.Copy(io.Discard, client)
+
+	write := func(frame []byte, timeout time.Duration) error {
+		client.SetWriteDeadline(time.Now().Add(timeout))
+		n, err := client.Write(frame)
+		if err != nil && n != 0 {
+			t.Fatalf("partial write of %d bytes: %v", n, err)
+		}
+		return err
+	}
+	// blocked checks that the session has stopped reading.
+	blocked := func(sid uint32) {
+		if err := write(smuxFrame(smuxCmdNOP, sid, nil), 100*time.Millisecond); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("session still reading: %v", err)
+		}
+	}
+
+	if err := write(smuxFrame(smuxCmdSYN, 1, nil), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	stream := acceptStream(t, s)
+
+	// The session reads frames until its buffer is exceeded.
+	chunk := make([]byte, smuxMaxFrameSize)
+	const accepted = smuxMaxReceiveBuffer/smuxMaxFrameSize + 1
+	for i := 0; i < accepted; i++ {
+		if err := write(smuxFrame(smuxCmdPSH, 1, chunk), 5*time.Second); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+	}
+	blocked(1)
+
+	// Reading drains the buffer and lets the rest in.
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.CopyN(io.Discard, stream, 2*accepted*smuxMaxFrameSize)
+		done <- err
+	}()
+	for i := 0; i < accepted; i++ {
+		if err := write(smuxFrame(smuxCmdPSH, 1, chunk), 5*time.Second); err != nil {
+			t.Fatalf("frame %d after reading: %v", i, err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing a stream with unread data releases it too.
+	if err := write(smuxFrame(smuxCmdSYN, 2, nil), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	other := acceptStream(t, s)
+	for i := 0; i < accepted; i++ {
+		if err := write(smuxFrame(smuxCmdPSH, 2, chunk), 5*time.Second); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+	}
+	blocked(2)
+
+	other.Close()
+	if err := write(smuxFrame(smuxCmdSYN, 3, nil), 5*time.Second); err != nil {
+		t.Fatalf("session still blocked after close: %v", err)
+	}
+	acceptStream(t, s)
+}
+
+func TestSmuxProcess(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	client, server := tcpPair(t)
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		muxProcess(server, "test")
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Each stream carries a simplesocks request.
+	for sid := uint32(1); sid <= 2; sid++ {
+		request := append([]byte{CmdConnect}, ParseAddr(echo.Addr().String())...)
+		client.Write(smuxFrame(smuxCmdSYN, sid, nil))
+		client.Write(smuxFrame(smuxCmdPSH, sid, append(request, "hello"...)))
+	}
+
+	echoed := map[uint32]string{}
+	for len(echoed) < 2 || echoed[1] != "hello" || echoed[2] != "hello" {
+		cmd, sid, data := readSmuxFrame(t, client)
+		if cmd != smuxCmdPSH {
+			t.Fatalf("frame cmd %d", cmd)
+		}
+		echoed[sid] += string(data)
+	}
+
+	// A FIN ends the stream's request side; the destination's close comes back as FIN.
+	client.Write(smuxFrame(smuxCmdFIN, 1, nil))
+	if cmd, sid, _ := readSmuxFrame(t, client); cmd != smuxCmdFIN || sid != 1 {
+		t.Fatalf("frame cmd %d, stream %d", cmd, sid)
+	}
+}
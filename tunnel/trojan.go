@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"io"
 	"log"
 	"net"
@@ -33,119 +34,177 @@ each UDP packet has the following format:
 +------+----------+----------+--------+---------+----------+
 */
 
-var (
-	psd = hexSha224([]byte("1234"))
-)
-
 func HandleTrojan(tlsConn net.Conn) {
 
-	connData := bufferPool.Get().(*byteReuse)
-	defer bufferPool.Put(connData)
+	connData := getBuffer(smallBufferSize)
+	defer putBuffer(connData)
 
-	n, err := tlsConn.Read(connData.buf)
+	user, cmd, addr, err := readTrojanRequest(tlsConn, connData.buf)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	rcvPsd := connData.buf[:trojanPasswordLenth]
+	switch cmd {
+	case CmdConnect:
+		tcpProcess(tlsConn, addr)
+	case CmdUDPAssociate:
+		udpProcess(tlsConn, user)
+	case trojanCmdMux:
+		muxProcess(tlsConn, user)
+	default:
 
-	if string(rcvPsd) != string(psd) {
-		return
 	}
 
-	cmd := connData.buf[trojanPasswordLenth+len(crlf)]
-	addr := SplitAddr(connData.buf[trojanPasswordLenth+len(crlf)+1:])
+}
+
+// muxProcess serves a Trojan-Go multiplexed session. The address in the
+// Trojan request is a placeholder; every stream carries its own.
+func muxProcess(conn net.Conn, user string) {
+	session := newMuxSession(conn)
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+		go handleSimpleSocks(stream, user)
+	}
+}
+
+// handleSimpleSocks serves one mux stream, which starts with CMD and a SOCKS address.
+func handleSimpleSocks(stream net.Conn, user string) {
+	defer stream.Close()
 
-	if addr == nil {
+	connData := getBuffer(smallBufferSize)
+	defer putBuffer(connData)
+
+	if _, err := io.ReadFull(stream, connData.buf[:1]); err != nil {
 		return
 	}
+	cmd := connData.buf[0]
+
+	addr, err := ReadAddr(stream, connData.buf)
+	if err != nil {
+		return
+	}
+	addr = append(Addr(nil), addr...)
 
 	switch cmd {
-	case 1:
-		tcpProcess(tlsConn, addr, connData, n)
-	case 3:
-		udpProcess(tlsConn, addr, connData)
+	case CmdConnect:
+		tcpProcess(stream, addr)
+	case CmdUDPAssociate:
+		udpProcess(stream, user)
 	default:
 
 	}
-
 }
 
-func tcpProcess(tlsConn net.Conn, addr Addr, connData *byteReuse, n int) {
+// readTrojanRequest reads the password, command and target address and
+// returns the authenticated user. The returned Addr does not alias buf.
+func readTrojanRequest(r io.Reader, buf []byte) (string, Command, Addr, error) {
+	header := buf[:trojanPasswordLenth+len(crlf)+1]
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", 0, nil, err
+	}
 
-	conn, err := net.Dial("tcp", addr.String())
-	if err != nil {
-		log.Println(err)
-		return
+	user, ok := Users.AuthTrojan(header[:trojanPasswordLenth])
+	if !ok {
+		return "", 0, nil, ErrAuth
 	}
 
-	payload := connData.buf[trojanPasswordLenth+len(crlf)+1+len(addr)+len(crlf) : n]
+	cmd := header[len(header)-1]
 
-	conn.Write(payload)
+	addr, err := ReadAddr(r, buf[len(header):])
+	if err != nil {
+		return "", 0, nil, err
+	}
+	addr = append(Addr(nil), addr...)
 
-	go io.CopyBuffer(tlsConn, conn, connData.buf)
+	if _, err := io.ReadFull(r, buf[:len(crlf)]); err != nil {
+		return "", 0, nil, err
+	}
 
-	// zero copy
-	io.CopyBuffer(conn, tlsConn, connData.buf)
+	return user, cmd, addr, nil
 }
 
-func udpProcess(tlsConn net.Conn, addr Addr, connData *byteReuse) {
-
-	udpListen, err := net.ListenUDP("udp", nil)
+// readTrojanUDP reads one UDP packet frame. Both return values are slices of buf.
+func readTrojanUDP(r io.Reader, buf []byte) (Addr, []byte, error) {
+	addr, err := ReadAddr(r, buf)
 	if err != nil {
-		return
+		return nil, nil, err
 	}
 
-	firstUdpAddr, err := net.ResolveUDPAddr("udp", addr.String())
-	if err != nil {
-		log.Println(err)
-		return
+	head := len(addr)
+	if _, err := io.ReadFull(r, buf[head:head+2+len(crlf)]); err != nil {
+		return nil, nil, err
 	}
 
-	n, err := tlsConn.Read(connData.buf)
-	if err != nil {
-		return
+	length := int(binary.BigEndian.Uint16(buf[head:]))
+	if head+2+len(crlf)+length > len(buf) {
+		return nil, nil, io.ErrShortBuffer
 	}
 
-	firstRecvAddr := SplitAddr(connData.buf[:n])
-	if firstRecvAddr == nil {
+	payload := buf[head+2+len(crlf) : head+2+len(crlf)+length]
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	return addr, payload, nil
+}
+
+func isTrojanPassword(b []byte) bool {
+	_, ok := Users.AuthTrojan(b)
+	return ok
+}
+
+func tcpProcess(tlsConn net.Conn, addr Addr) {
+
+	conn, err := DefaultEgress.Dial("tcp", addr)
+	if err != nil {
+		log.Println(err)
 		return
 	}
+	defer conn.Close()
 
-	_, err = udpListen.WriteToUDP(connData.buf[len(firstRecvAddr)+4:n], firstUdpAddr)
+	relay(tlsConn, conn)
+}
+
+// udpProcess relays UDP packets, each of which carries its own destination.
+// The session ends when either side fails or goes quiet for the idle timeout.
+func udpProcess(tlsConn net.Conn, user string) {
+
+	session, err := DefaultEgress.listenUDPSession(user)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	defer session.Close()
 
 	// client <-- destination
 
 	go func() {
+		// Unblock the client reader once the relay is done.
+		defer tlsConn.Close()
 
-		udpHeaderBuf := bufferPool.Get().(*byteReuse)
-		defer bufferPool.Put(udpHeaderBuf)
+		udpHeaderBuf := getBuffer(largeBufferSize)
+		defer putBuffer(udpHeaderBuf)
 
-		payload := bufferPool.Get().(*byteReuse)
-		defer bufferPool.Put(payload)
+		payload := getBuffer(largeBufferSize)
+		defer putBuffer(payload)
 
 		for {
 
-			n, udpAddr, err := udpListen.ReadFromUDP(payload.buf)
+			n, udpAddr, err := session.ReadFrom(payload.buf)
 			if err != nil {
-				log.Println(err)
+				if err != errUDPIdle && !errors.Is(err, net.ErrClosed) {
+					log.Println(err)
+				}
 				return
 			}
 
 			// Protocol: addr len(payload) crlf payload
 			udpHeaderBuf.buf = udpHeaderBuf.buf[:0]
-
-			if udpAddr.IP.Equal(firstUdpAddr.IP) && udpAddr.Port == firstUdpAddr.Port {
-				udpHeaderBuf.buf = append(udpHeaderBuf.buf, firstRecvAddr...)
-			} else {
-				udpHeaderBuf.buf = append(udpHeaderBuf.buf, ParseAddrToSocksAddr(udpAddr)...)
-			}
-
+			udpHeaderBuf.buf = append(udpHeaderBuf.buf, udpAddr...)
 			udpHeaderBuf.buf = binary.BigEndian.AppendUint16(udpHeaderBuf.buf, uint16(n))
 			udpHeaderBuf.buf = append(udpHeaderBuf.buf, crlf...)
 			udpHeaderBuf.buf = append(udpHeaderBuf.buf, payload.buf[:n]...)
@@ -162,21 +221,20 @@ func udpProcess(tlsConn net.Conn, addr Addr, connData *byteReuse) {
 
 	//client --> destination
 
+	connData := getBuffer(largeBufferSize)
+	defer putBuffer(connData)
+
 	for {
-		n, err := tlsConn.Read(connData.buf)
+		recvAddr, payload, err := readTrojanUDP(tlsConn, connData.buf)
 		if err != nil {
 			return
 		}
 
-		recvAddr := SplitAddr(connData.buf[:n])
-
-		if string(recvAddr) == string(firstRecvAddr) {
-			_, err = udpListen.WriteToUDP(connData.buf[len(recvAddr)+4:n], firstUdpAddr)
-		} else {
-			_, err = udpListen.WriteToUDP(connData.buf[len(recvAddr)+4:n], recvAddr.UDPAddr())
+		if !DefaultEgress.AllowUDP(recvAddr) {
+			continue
 		}
 
-		if err != nil {
+		if err := session.WriteTo(payload, recvAddr); err != nil {
 			return
 		}
 
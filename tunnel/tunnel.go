@@ -9,6 +9,7 @@ import (
 	"github.com/Blocked233/middleware/proto"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
 )
 
 var (
@@ -18,23 +19,70 @@ var (
 	crlf                = []byte{'\r', '\n'}
 )
 
+// DefaultGrpcMessageSize is the largest TCP chunk sent in one Tun message.
+const DefaultGrpcMessageSize = mediumBufferSize
+
+// grpcConnWindowSize is the connection flow control window of the gRPC server.
+const grpcConnWindowSize = 10 << 20
+
+// trojanCmdMux is the Trojan-Go command for a multiplexed session.
+const trojanCmdMux Command = 0x7f
+
+// MessageService implements the Message service. With a nil Handler every
+// stream carries a Trojan session, one chunk or UDP packet per message.
+// Otherwise the stream is passed to Handler as a net.Conn, e.g. HandleVLESS.
 type MessageService struct {
 	proto.MessageServer
+	Handler func(net.Conn)
+
+	// MessageSize is the largest TCP chunk sent in one Trojan message, at
+	// most largeBufferSize. Zero means DefaultGrpcMessageSize.
+	MessageSize int
 }
 
 func init() {
 
-	GrpcServer = grpc.NewServer(grpc.InitialConnWindowSize(1024 * 1024 * 10))
-	proto.RegisterMessageServer(GrpcServer, new(MessageService))
+	GrpcServer = NewGrpcServer(nil)
+
+}
+
+// NewGrpcServer returns a gRPC server whose Message.Tun streams are served
+// by handler, see MessageService. Messages are encoded with Codec unless
+// opts force another codec.
+func NewGrpcServer(handler func(net.Conn), opts ...grpc.ServerOption) *grpc.Server {
+	return newGrpcServer(&MessageService{Handler: handler}, opts...)
+}
 
+func newGrpcServer(service *MessageService, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append([]grpc.ServerOption{
+		grpc.InitialConnWindowSize(grpcConnWindowSize),
+		grpc.ForceServerCodec(Codec{}),
+		// Let clients such as GrpcPool ping idle connections.
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             grpcKeepaliveMinTime,
+			PermitWithoutStream: true,
+		}),
+	}, opts...)
+
+	s := grpc.NewServer(opts...)
+	proto.RegisterMessageServer(s, service)
+	return s
 }
 
 func (h MessageService) Tun(stream proto.Message_TunServer) error {
 
-	defer stream.Context().Done()
+	if h.Handler != nil {
+		conn := newStreamConn(stream)
+		go func() {
+			defer conn.Close()
+			h.Handler(conn)
+		}()
+		<-conn.done
+		return nil
+	}
 
-	rcvBytes := tunBytesPool.New().(*proto.TunByte)
-	defer tunBytesPool.Put(rcvBytes)
+	rcvBytes := getTunByte()
+	defer putTunByte(rcvBytes)
 
 	//First data
 
@@ -43,133 +91,218 @@ func (h MessageService) Tun(stream proto.Message_TunServer) error {
 		return err
 	}
 
+	if len(rcvBytes.Data) < trojanPasswordLenth+len(crlf)+1 {
+		return ErrAuth
+	}
+	user, ok := Users.AuthTrojan(rcvBytes.Data[:trojanPasswordLenth])
+	if !ok {
+		return ErrAuth
+	}
+
 	cmd := rcvBytes.Data[trojanPasswordLenth+len(crlf)]
 	addr := SplitAddr(rcvBytes.Data[trojanPasswordLenth+len(crlf)+1:])
 
-	if addr == nil {
+	if addr == nil || len(rcvBytes.Data) < trojanPasswordLenth+len(crlf)+1+len(addr)+len(crlf) {
 		return errors.New("wrong addr")
 	}
 
 	if cmd == 1 {
-		return stdtcpProcess(stream, addr, rcvBytes)
+		return stdtcpProcess(stream, addr, rcvBytes, h.messageSize())
 	}
 	if cmd == 3 {
-		return stdudpProcess(stream, addr, rcvBytes)
+		return stdudpProcess(stream, user, addr, rcvBytes)
+	}
+	if cmd == trojanCmdMux {
+		conn := newStreamConn(stream)
+		defer conn.Close()
+		conn.pending = rcvBytes.Data[trojanPasswordLenth+len(crlf)+1+len(addr)+len(crlf):]
+		muxProcess(conn, user)
+		return nil
 	}
 	return errors.New("wrong cmd")
 }
 
-func stdtcpProcess(stream proto.Message_TunServer, addr Addr, rcvBytes *proto.TunByte) error {
+func (h MessageService) messageSize() int {
+	if h.MessageSize <= 0 {
+		return DefaultGrpcMessageSize
+	}
+	return h.MessageSize
+}
+
+// stdtcpProcess relays a TCP connection, one chunk of up to messageSize bytes
+// per message.
+//
+// Every pooled message and buffer has a single owner goroutine that returns
+// it to the pool. Send must not be called once the handler has returned, so
+// the handler always waits for the sender; the receiver may outlive the
+// handler until its RecvMsg fails.
+func stdtcpProcess(stream proto.Message_TunServer, addr Addr, rcvBytes *proto.TunByte, messageSize int) error {
 
 	payload := rcvBytes.Data[trojanPasswordLenth+len(crlf)+1+len(addr)+len(crlf):]
 
-	conn, err := net.Dial("tcp", addr.String())
+	conn, err := DefaultEgress.Dial("tcp", addr)
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
 
-	conn.Write(payload)
+	if len(payload) > 0 {
+		if _, err := conn.Write(payload); err != nil {
+			return err
+		}
+	}
 
-	// client <-- destination
+	//client --> destination
 
+	recvErr := make(chan error, 1)
 	go func() {
-		buf := bufferPool.Get().(*byteReuse)
-		defer bufferPool.Put(buf)
-
-		sendBytes := tunBytesPool.Get().(*proto.TunByte)
-		defer tunBytesPool.Put(sendBytes)
+		recvBytes := getTunByte()
+		defer putTunByte(recvBytes)
 
 		for {
-
-			n, err := conn.Read(buf.buf)
+			err := stream.RecvMsg(recvBytes)
 			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				recvErr <- err
 				return
 			}
 
-			sendBytes.Data = buf.buf[:n]
-
-			err = stream.Send(sendBytes)
-			if err != nil {
+			if _, err := conn.Write(recvBytes.Data); err != nil {
+				recvErr <- err
 				return
 			}
 		}
 	}()
 
-	//client --> destination
+	// client <-- destination
 
-	for {
-		err := stream.RecvMsg(rcvBytes)
-		if err != nil {
-			if err == io.EOF {
-				return nil
-			}
-			return err
+	sendErr := make(chan error, 1)
+	go func() {
+		buf := getBuffer(messageSize)
+		defer putBuffer(buf)
+
+		sendBytes := getTunByte()
+		defer putTunByte(sendBytes)
+
+		chunk := buf.buf
+		if len(chunk) > messageSize {
+			chunk = chunk[:messageSize]
 		}
 
-		_, err = conn.Write(rcvBytes.Data)
-		if err != nil {
-			if err == io.EOF {
-				return nil
+		for {
+			n, err := conn.Read(chunk)
+			if err != nil {
+				if err == io.EOF || errors.Is(err, net.ErrClosed) {
+					err = nil
+				}
+				sendErr <- err
+				return
+			}
+
+			// Send serializes the message before returning, so chunk
+			// can be reused right away.
+			sendBytes.Data = chunk[:n]
+			err = stream.Send(sendBytes)
+			sendBytes.Data = nil
+			if err != nil {
+				sendErr <- err
+				return
 			}
-			return err
 		}
+	}()
 
+	select {
+	case err = <-recvErr:
+		// Let the destination finish its response after a client half-close.
+		if err != nil || !closeWrite(conn) {
+			conn.Close()
+		}
+		if sendErr := <-sendErr; err == nil {
+			err = sendErr
+		}
+	case err = <-sendErr:
 	}
+	return err
 }
 
-func stdudpProcess(stream proto.Message_TunServer, addr Addr, rcvBytes *proto.TunByte) error {
+func stdudpProcess(stream proto.Message_TunServer, user string, addr Addr, rcvBytes *proto.TunByte) error {
 
-	udpListen, err := net.ListenUDP("udp", nil)
+	session, err := DefaultEgress.listenUDPSession(user)
 	if err != nil {
 		return err
 	}
-
-	err = stream.RecvMsg(rcvBytes)
-	if err != nil {
-		return err
+	defer session.Close()
+
+	// The first message may already carry a packet after the request.
+	first := rcvBytes.Data[trojanPasswordLenth+len(crlf)+1+len(addr)+len(crlf):]
+	if len(first) > 0 {
+		if recvAddr, payload := splitTrojanUDP(first); recvAddr != nil && DefaultEgress.AllowUDP(recvAddr) {
+			if err := session.WriteTo(payload, recvAddr); err != nil {
+				return err
+			}
+		}
 	}
 
-	firstRecvAddr := SplitAddr(rcvBytes.Data)
-	if firstRecvAddr == nil {
-		return nil
-	}
+	//client --> destination
 
-	firstUdpAddr, err := net.ResolveUDPAddr("udp", addr.String())
-	if err != nil {
-		return err
-	}
+	// RecvMsg can't be interrupted, so the client side runs in its own
+	// goroutine and the stream ends as soon as either direction is done.
+	recvErr := make(chan error, 1)
+	go func() {
+		recvBytes := getTunByte()
+		defer putTunByte(recvBytes)
 
-	udpListen.WriteToUDP(rcvBytes.Data[len(firstRecvAddr)+4:], firstUdpAddr)
+		for {
+			err := stream.RecvMsg(recvBytes)
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				recvErr <- err
+				return
+			}
 
-	// client <-- destination
+			recvAddr, payload := splitTrojanUDP(recvBytes.Data)
+			if recvAddr == nil || !DefaultEgress.AllowUDP(recvAddr) {
+				continue
+			}
 
-	go func() {
+			if err := session.WriteTo(payload, recvAddr); err != nil {
+				recvErr <- err
+				return
+			}
+		}
+	}()
 
-		udpHeaderBuf := bufferPool.Get().(*byteReuse)
-		defer bufferPool.Put(udpHeaderBuf)
+	// client <-- destination
+
+	udpHeaderBuf := getBuffer(largeBufferSize)
+	defer putBuffer(udpHeaderBuf)
 
-		payload := bufferPool.Get().(*byteReuse)
-		defer bufferPool.Put(payload)
+	payload := getBuffer(largeBufferSize)
+	defer putBuffer(payload)
 
-		sendBytes := tunBytesPool.Get().(*proto.TunByte)
-		defer tunBytesPool.Put(sendBytes)
+	sendBytes := getTunByte()
+	defer putTunByte(sendBytes)
 
+	sendErr := make(chan error, 1)
+	go func() {
 		for {
 
-			n, udpAddr, err := udpListen.ReadFromUDP(payload.buf)
+			n, udpAddr, err := session.ReadFrom(payload.buf)
 			if err != nil {
+				if err == errUDPIdle {
+					err = nil
+				}
+				sendErr <- err
 				return
 			}
 
 			// Protocol: addr len(payload) crlf payload
 			udpHeaderBuf.buf = udpHeaderBuf.buf[:0]
-
-			if udpAddr.IP.Equal(firstUdpAddr.IP) && udpAddr.Port == firstUdpAddr.Port {
-				udpHeaderBuf.buf = append(udpHeaderBuf.buf, firstRecvAddr...)
-			} else {
-				udpHeaderBuf.buf = append(udpHeaderBuf.buf, ParseAddrToSocksAddr(udpAddr)...)
-			}
-
+			udpHeaderBuf.buf = append(udpHeaderBuf.buf, udpAddr...)
 			udpHeaderBuf.buf = binary.BigEndian.AppendUint16(udpHeaderBuf.buf, uint16(n))
 			udpHeaderBuf.buf = append(udpHeaderBuf.buf, crlf...)
 			udpHeaderBuf.buf = append(udpHeaderBuf.buf, payload.buf[:n]...)
@@ -178,36 +311,34 @@ func stdudpProcess(stream proto.Message_TunServer, addr Addr, rcvBytes *proto.Tu
 
 			err = stream.Send(sendBytes)
 			if err != nil {
+				sendErr <- err
 				return
 			}
 
 		}
 	}()
 
-	//client --> destination
-
-	for {
-		err := stream.RecvMsg(rcvBytes)
-		if err != nil {
-			if err == io.EOF {
-				return nil
-			}
-			return err
-		}
-
-		recvAddr := SplitAddr(rcvBytes.Data)
-		if string(recvAddr) == string(firstRecvAddr) {
-			_, err = udpListen.WriteToUDP(rcvBytes.Data[len(recvAddr)+4:], firstUdpAddr)
-		} else {
-			_, err = udpListen.WriteToUDP(rcvBytes.Data[len(recvAddr)+4:], recvAddr.UDPAddr())
-		}
+	select {
+	case err = <-recvErr:
+		session.Close()
+		<-sendErr
+	case err = <-sendErr:
+	}
+	return err
+}
 
-		if err != nil {
-			if err == io.EOF {
-				return nil
-			}
-			return err
-		}
+// splitTrojanUDP parses a UDP packet frame received as a single message.
+// Returns a nil Addr if the frame is malformed.
+func splitTrojanUDP(b []byte) (Addr, []byte) {
+	addr := SplitAddr(b)
+	if addr == nil || len(b) < len(addr)+2+len(crlf) {
+		return nil, nil
+	}
 
+	length := int(binary.BigEndian.Uint16(b[len(addr):]))
+	payload := b[len(addr)+2+len(crlf):]
+	if len(payload) < length {
+		return nil, nil
 	}
+	return addr, payload[:length]
 }
@@ -0,0 +1,325 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Blocked233/middleware/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// testPassword and testUUID are the Trojan password and the VLESS UUID of
+// the user the tests connect as.
+const testPassword = "1234"
+
+var testUUID = UUID{0x27, 0x84, 0x8a, 0x9d, 0xf1, 0x10, 0x4b, 0x3e, 0x8c, 0x5f, 0x13, 0x9e, 0x21, 0x0b, 0x4d, 0x6a}
+
+func TestMain(m *testing.M) {
+	Users.Add("test", testPassword)
+	Users.AddUUID("test", testUUID)
+	os.Exit(m.Run())
+}
+
+// sourceServer writes zeros to every connection until it is closed.
+func sourceServer(tb testing.TB) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				chunk := make([]byte, largeBufferSize)
+				for {
+					if _, err := conn.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+// echoServer echoes every connection until the client half-closes it.
+func echoServer(tb testing.TB) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+// udpEchoServer echoes every UDP packet back to its sender.
+func udpEchoServer(tb testing.TB) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, largeBufferSize)
+		for {
+			n, from, err := conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDPAddrPort(buf[:n], from)
+		}
+	}()
+	return conn
+}
+
+// startGrpc serves the tunnel gRPC service with handler, see NewGrpcServer.
+func startGrpc(tb testing.TB, handler func(net.Conn)) (*grpc.ClientConn, func()) {
+	return startGrpcService(tb, &MessageService{Handler: handler})
+}
+
+func startGrpcService(tb testing.TB, service *MessageService) (*grpc.ClientConn, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	server := newGrpcServer(service)
+	go server.Serve(ln)
+
+	cc, err := grpc.Dial(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return cc, func() {
+		cc.Close()
+		server.Stop()
+	}
+}
+
+// openTun opens a Tun stream carrying a Trojan CONNECT to target.
+func openTun(ctx context.Context, tb testing.TB, cc *grpc.ClientConn, target string) proto.Message_TunClient {
+	stream, err := proto.NewMessageClient(cc).Tun(ctx)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	header := append(hexSha224([]byte(testPassword)), crlf...)
+	header = append(header, CmdConnect)
+	header = append(header, ParseAddr(target)...)
+	header = append(header, crlf...)
+	if err := stream.Send(&proto.TunByte{Data: header}); err != nil {
+		tb.Fatal(err)
+	}
+	return stream
+}
+
+func TestGrpcTCPConcurrent(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	cc, stop := startGrpc(t, nil)
+	defer stop()
+
+	// Streams are opened here, openTun may stop the test.
+	streams := make([]proto.Message_TunClient, 8)
+	for i := range streams {
+		streams[i] = openTun(context.Background(), t, cc, echo.Addr().String())
+	}
+
+	var wg sync.WaitGroup
+	for i, stream := range streams {
+		wg.Add(1)
+		go func(stream proto.Message_TunClient, seed int64) {
+			defer wg.Done()
+
+			rnd := rand.New(rand.NewSource(seed))
+
+			var sent bytes.Buffer
+			sendErr := make(chan error, 1)
+			go func() {
+				for j := 0; j < 200; j++ {
+					msg := make([]byte, 1+rnd.Intn(4*largeBufferSize))
+					rnd.Read(msg)
+					sent.Write(msg)
+					if err := stream.Send(&proto.TunByte{Data: msg}); err != nil {
+						sendErr <- err
+						return
+					}
+				}
+				sendErr <- stream.CloseSend()
+			}()
+
+			// The stream ends once the destination has echoed everything
+			// and closed after the half-close.
+			var received bytes.Buffer
+			for {
+				msg, err := stream.Recv()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				received.Write(msg.Data)
+			}
+
+			if err := <-sendErr; err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(received.Bytes(), sent.Bytes()) {
+				t.Errorf("received %d bytes, sent %d", received.Len(), sent.Len())
+			}
+		}(stream, int64(i))
+	}
+	wg.Wait()
+}
+
+func TestGrpcTCPTeardown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	closed := make(chan struct{})
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Keep sending until the tunnel drops the connection.
+		chunk := make([]byte, mediumBufferSize)
+		for {
+			if _, err := conn.Write(chunk); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	cc, stop := startGrpc(t, nil)
+	defer stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := openTun(ctx, t, cc, ln.Addr().String())
+	for i := 0; i < 10; i++ {
+		if _, err := stream.Recv(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("destination not closed after the stream was canceled")
+	}
+}
+
+func TestStreamConnTeardown(t *testing.T) {
+	writeErrs := make(chan error, 4)
+	handler := func(conn net.Conn) {
+		// Writers racing with the handler's return must not reach the stream.
+		for i := 0; i < cap(writeErrs); i++ {
+			go func() {
+				var err error
+				for err == nil {
+					_, err = conn.Write([]byte("data"))
+				}
+				writeErrs <- err
+			}()
+		}
+
+		buf := make([]byte, 16)
+		conn.Read(buf)
+	}
+
+	cc, stop := startGrpc(t, handler)
+	defer stop()
+
+	stream, err := proto.NewMessageClient(cc).Tun(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&proto.TunByte{Data: []byte("bye")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stream is finished once the handler returns.
+	for {
+		if _, err := stream.Recv(); err != nil {
+			if err != io.EOF {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+
+	for i := 0; i < cap(writeErrs); i++ {
+		if err := <-writeErrs; !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("write after close: %v", err)
+		}
+	}
+}
+
+func BenchmarkGrpcDownload(b *testing.B) {
+	source := sourceServer(b)
+	defer source.Close()
+
+	for _, size := range []int{smallBufferSize, mediumBufferSize, largeBufferSize} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			cc, stop := startGrpcService(b, &MessageService{MessageSize: size})
+			defer stop()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			stream := openTun(ctx, b, cc, source.Addr().String())
+
+			const perOp = 1 << 20
+			b.SetBytes(perOp)
+			b.ResetTimer()
+
+			received := 0
+			for i := 0; i < b.N; i++ {
+				for received < perOp {
+					msg, err := stream.Recv()
+					if err != nil {
+						b.Fatal(err)
+					}
+					received += len(msg.Data)
+				}
+				received -= perOp
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package tunnel
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NATMode controls which sources may send UDP replies to a client.
+type NATMode int
+
+const (
+	// FullCone accepts replies from any source once the client has sent a packet.
+	FullCone NATMode = iota
+	// RestrictedCone accepts replies from hosts the client has sent to, on any port.
+	RestrictedCone
+	// PortRestrictedCone accepts replies only from the exact addresses the client has sent to.
+	PortRestrictedCone
+)
+
+const (
+	// DefaultUDPMappingTimeout is how long an idle destination mapping is kept.
+	DefaultUDPMappingTimeout = 2 * time.Minute
+	// DefaultUDPIdleTimeout closes a UDP session without traffic in either direction.
+	DefaultUDPIdleTimeout = time.Minute
+)
+
+var (
+	ErrTooManyUDPSessions = errors.New("too many UDP sessions")
+
+	errUDPIdle = errors.New("UDP session idle")
+)
+
+// udpMapping remembers how the client addressed a destination.
+type udpMapping struct {
+	clientAddr Addr
+	target     netip.AddrPort
+	lastActive time.Time
+}
+
+// udpSession is the UDP relay of one client session. Destinations are
+// resolved once and replies are reported with the address form the client used.
+type udpSession struct {
+	conn    *net.UDPConn
+	mode    NATMode
+	timeout time.Duration
+	idle    time.Duration
+
+	lastActive atomic.Int64
+	release    func()
+	closeOnce  sync.Once
+
+	// allow checks resolved destinations, nil allows all.
+	allow func(Addr) bool
+
+	// now is the clock of the mapping timeout.
+	now func() time.Time
+
+	mu         sync.Mutex
+	byClient   map[string]*udpMapping         // string(Addr) -> mapping
+	byTarget   map[netip.AddrPort]*udpMapping // resolved address -> mapping
+	hosts      map[netip.Addr]int             // mappings per host, for RestrictedCone
+	lastExpiry time.Time
+}
+
+func newUDPSession(conn *net.UDPConn, mode NATMode, timeout, idle time.Duration) *udpSession {
+	if timeout <= 0 {
+		timeout = DefaultUDPMappingTimeout
+	}
+	if idle <= 0 {
+		idle = DefaultUDPIdleTimeout
+	}
+	s := &udpSession{
+		conn:     conn,
+		mode:     mode,
+		timeout:  timeout,
+		idle:     idle,
+		byClient: make(map[string]*udpMapping),
+		byTarget: make(map[netip.AddrPort]*udpMapping),
+		hosts:    make(map[netip.Addr]int),
+		now:      time.Now,
+	}
+	s.lastExpiry = s.now()
+	s.touch()
+	return s
+}
+
+// Close closes the relay socket, which also ends a pending ReadFrom.
+func (s *udpSession) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		err = s.conn.Close()
+		if s.release != nil {
+			s.release()
+		}
+	})
+	return err
+}
+
+func (s *udpSession) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// WriteTo sends payload to addr. Packets for destinations that can't be
+// resolved or resolve to addresses the policy denies are dropped; only
+// socket errors are returned.
+func (s *udpSession) WriteTo(payload []byte, addr Addr) error {
+	m, err := s.mapping(addr)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	s.touch()
+	_, err = s.conn.WriteToUDPAddrPort(payload, m.target)
+	return err
+}
+
+// ReadFrom reads the next permitted reply and returns its source as the
+// client knows it. It fails with errUDPIdle once no packet has been sent or
+// received for the idle timeout.
+func (s *udpSession) ReadFrom(b []byte) (int, Addr, error) {
+	for {
+		last := time.Unix(0, s.lastActive.Load())
+		if time.Since(last) >= s.idle {
+			return 0, nil, errUDPIdle
+		}
+
+		s.conn.SetReadDeadline(last.Add(s.idle))
+		n, from, err := s.conn.ReadFromUDPAddrPort(b)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return 0, nil, err
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+
+		if addr := s.lookup(from); addr != nil {
+			s.touch()
+			return n, addr, nil
+		}
+	}
+}
+
+func (s *udpSession) mapping(addr Addr) (*udpMapping, error) {
+	now := s.now()
+	key := string(addr)
+
+	s.mu.Lock()
+	s.expireLocked(now)
+	m := s.byClient[key]
+	if m != nil {
+		m.lastActive = now
+		s.mu.Unlock()
+		return m, nil
+	}
+	s.mu.Unlock()
+
+	// Resolve without holding the lock.
+	udpAddr, err := net.ResolveUDPAddr("udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	target := udpAddr.AddrPort()
+	target = netip.AddrPortFrom(target.Addr().Unmap(), target.Port())
+	if s.allow != nil && !s.allow(AddrFromStdAddrPort(target)) {
+		return nil, ErrNotAllowed
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m := s.byClient[key]; m != nil {
+		m.lastActive = now
+		return m, nil
+	}
+
+	m = &udpMapping{clientAddr: append(Addr(nil), addr...), target: target, lastActive: now}
+	s.byClient[key] = m
+	if old := s.byTarget[target]; old == nil {
+		s.hosts[target.Addr()]++
+	}
+	// The latest name wins if several resolve to the same address.
+	s.byTarget[target] = m
+	return m, nil
+}
+
+func (s *udpSession) lookup(from netip.AddrPort) Addr {
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m := s.byTarget[from]; m != nil {
+		m.lastActive = now
+		return m.clientAddr
+	}
+
+	switch s.mode {
+	case FullCone:
+	case RestrictedCone:
+		if s.hosts[from.Addr()] == 0 {
+			return nil
+		}
+	default:
+		return nil
+	}
+	return AddrFromStdAddrPort(from)
+}
+
+// expireLocked drops idle mappings, at most once per timeout/2.
+func (s *udpSession) expireLocked(now time.Time) {
+	if now.Sub(s.lastExpiry) < s.timeout/2 {
+		return
+	}
+	s.lastExpiry = now
+
+	for key, m := range s.byClient {
+		if now.Sub(m.lastActive) < s.timeout {
+			continue
+		}
+		delete(s.byClient, key)
+		if s.byTarget[m.target] == m {
+			s.retargetLocked(m.target)
+		}
+	}
+}
+
+// retargetLocked points target at another live mapping, or forgets it.
+func (s *udpSession) retargetLocked(target netip.AddrPort) {
+	for _, m := range s.byClient {
+		if m.target == target {
+			s.byTarget[target] = m
+			return
+		}
+	}
+
+	delete(s.byTarget, target)
+	if s.hosts[target.Addr()]--; s.hosts[target.Addr()] <= 0 {
+		delete(s.hosts, target.Addr())
+	}
+}
@@ -0,0 +1,189 @@
+package tunnel
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// udpPeer is a UDP socket on ip that can reply to a session.
+func udpPeer(tb testing.TB, ip net.IP) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func newTestUDPSession(tb testing.TB, mode NATMode, timeout, idle time.Duration) *udpSession {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s := newUDPSession(conn, mode, timeout, idle)
+	tb.Cleanup(func() { s.Close() })
+	return s
+}
+
+// readFrom reads the next packet the session lets through.
+func readFrom(tb testing.TB, s *udpSession) (string, Addr) {
+	buf := make([]byte, largeBufferSize)
+	n, from, err := s.ReadFrom(buf)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return string(buf[:n]), from
+}
+
+func TestUDPNATModes(t *testing.T) {
+	for _, tt := range []struct {
+		mode NATMode
+		// Whether replies pass from another port of the host the client
+		// sent to, and from another host.
+		otherPort, otherHost bool
+	}{
+		{FullCone, true, true},
+		{RestrictedCone, true, false},
+		{PortRestrictedCone, false, false},
+	} {
+		s := newTestUDPSession(t, tt.mode, time.Minute, time.Minute)
+		local := s.conn.LocalAddr()
+
+		sent := udpPeer(t, net.IPv4(127, 0, 0, 1))
+		otherPort := udpPeer(t, net.IPv4(127, 0, 0, 1))
+		otherHost := udpPeer(t, net.IPv4(127, 0, 0, 2))
+
+		if err := s.WriteTo([]byte("out"), ParseAddr(sent.LocalAddr().String())); err != nil {
+			t.Fatal(err)
+		}
+
+		// A reply from the destination always passes. Each probe is
+		// followed by one, so a dropped probe shows as the reply coming first.
+		for _, probe := range []struct {
+			conn *net.UDPConn
+			pass bool
+		}{
+			{otherPort, tt.otherPort},
+			{otherHost, tt.otherHost},
+		} {
+			probe.conn.WriteTo([]byte("probe"), local)
+			sent.WriteTo([]byte("reply"), local)
+
+			data, from := readFrom(t, s)
+			if probe.pass {
+				if data != "probe" || from.String() != probe.conn.LocalAddr().String() {
+					t.Fatalf("mode %d: got %q from %s, want the probe", tt.mode, data, from)
+				}
+				data, from = readFrom(t, s)
+			}
+			if data != "reply" || from.String() != sent.LocalAddr().String() {
+				t.Fatalf("mode %d: got %q from %s, want the reply", tt.mode, data, from)
+			}
+		}
+	}
+}
+
+func TestUDPMappingReuse(t *testing.T) {
+	s := newTestUDPSession(t, PortRestrictedCone, time.Minute, time.Minute)
+	peer := udpPeer(t, net.IPv4(127, 0, 0, 1))
+	port := peer.LocalAddr().(*net.UDPAddr).Port
+
+	byIP := ParseAddr(peer.LocalAddr().String())
+	byName := ParseAddr(net.JoinHostPort("localhost", strconv.Itoa(port)))
+
+	s.WriteTo([]byte("a"), byIP)
+	first := s.byClient[string(byIP)]
+	s.WriteTo([]byte("b"), byIP)
+	if s.byClient[string(byIP)] != first || len(s.byClient) != 1 {
+		t.Fatal("mapping not reused")
+	}
+
+	// Both names resolve to the same address; replies are reported the way
+	// the client addressed it last.
+	s.WriteTo([]byte("c"), byName)
+	if len(s.byClient) != 2 || len(s.byTarget) != 1 || s.hosts[netip.MustParseAddr("127.0.0.1")] != 1 {
+		t.Fatalf("%d client addresses, %d targets, hosts %v", len(s.byClient), len(s.byTarget), s.hosts)
+	}
+	peer.WriteTo([]byte("reply"), s.conn.LocalAddr())
+	if _, from := readFrom(t, s); from.String() != byName.String() {
+		t.Fatalf("reply from %s", from)
+	}
+}
+
+func TestUDPMappingExpiry(t *testing.T) {
+	const timeout = time.Minute
+	s := newTestUDPSession(t, PortRestrictedCone, timeout, time.Minute)
+	clock := s.now()
+	s.now = func() time.Time { return clock }
+
+	peer := udpPeer(t, net.IPv4(127, 0, 0, 1))
+	other := udpPeer(t, net.IPv4(127, 0, 0, 2))
+	peerAddr := ParseAddr(peer.LocalAddr().String())
+	port := peer.LocalAddr().(*net.UDPAddr).Port
+	byName := ParseAddr(net.JoinHostPort("localhost", strconv.Itoa(port)))
+
+	s.WriteTo([]byte("a"), peerAddr)
+	clock = clock.Add(timeout / 2)
+	// Keeps the address mapped under another name.
+	s.WriteTo([]byte("b"), byName)
+	clock = clock.Add(timeout/2 + time.Second)
+
+	// Expiry runs as packets are sent: the first name is gone, the address
+	// now maps to the name still in use.
+	s.WriteTo([]byte("c"), ParseAddr(other.LocalAddr().String()))
+	s.mu.Lock()
+	_, stale := s.byClient[string(peerAddr)]
+	target := s.byTarget[netip.MustParseAddrPort(peer.LocalAddr().String())]
+	s.mu.Unlock()
+	if stale || target == nil || target.clientAddr.String() != byName.String() {
+		t.Fatalf("after the first expiry: first name mapped %v, target %v", stale, target)
+	}
+
+	// Once no name is left, replies from the address are dropped.
+	clock = clock.Add(timeout)
+	s.WriteTo([]byte("d"), ParseAddr(other.LocalAddr().String()))
+	s.mu.Lock()
+	mappings, hosts := len(s.byClient), len(s.hosts)
+	s.mu.Unlock()
+	if mappings != 1 || hosts != 1 {
+		t.Fatalf("%d mappings and %d hosts left, want only the other host", mappings, hosts)
+	}
+
+	peer.WriteTo([]byte("expired"), s.conn.LocalAddr())
+	other.WriteTo([]byte("live"), s.conn.LocalAddr())
+	if data, _ := readFrom(t, s); data != "live" {
+		t.Fatalf("got %q", data)
+	}
+}
+
+func TestUDPIdleTimeout(t *testing.T) {
+	const idle = 150 * time.Millisecond
+	s := newTestUDPSession(t, FullCone, time.Minute, idle)
+	peer := udpPeer(t, net.IPv4(127, 0, 0, 1))
+
+	start := time.Now()
+	idled := make(chan error, 1)
+	go func() {
+		_, _, err := s.ReadFrom(make([]byte, largeBufferSize))
+		idled <- err
+	}()
+
+	// Sending keeps the session alive, whether or not replies come.
+	time.Sleep(idle / 2)
+	s.WriteTo([]byte("out"), ParseAddr(peer.LocalAddr().String()))
+
+	select {
+	case err := <-idled:
+		if err != errUDPIdle {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed < idle+idle/2 {
+			t.Fatalf("idle after %v despite traffic", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session never went idle")
+	}
+}
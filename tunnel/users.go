@@ -0,0 +1,122 @@
+package tunnel
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// Users is the user store consulted by every inbound protocol. It starts
+// empty, so every client is rejected until users are added.
+var Users = NewUserStore()
+
+var errInvalidUUID = errors.New("invalid UUID")
+
+// UUID identifies a VLESS user.
+type UUID [16]byte
+
+// ParseUUID parses the canonical 8-4-4-4-12 hex form.
+func ParseUUID(s string) (UUID, error) {
+	var id UUID
+	s = strings.ReplaceAll(s, "-", "")
+	if len(s) != 32 {
+		return id, errInvalidUUID
+	}
+	if _, err := hex.Decode(id[:], []byte(s)); err != nil {
+		return id, errInvalidUUID
+	}
+	return id, nil
+}
+
+func (id UUID) String() string {
+	h := hex.EncodeToString(id[:])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// UserStore maps user names to passwords and UUIDs and indexes the Trojan password hashes.
+type UserStore struct {
+	mu        sync.RWMutex
+	passwords map[string]string // name -> password
+	hashes    map[string]string // hex(SHA224(password)) -> name
+	uuids     map[UUID]string   // UUID -> name
+}
+
+func NewUserStore() *UserStore {
+	return &UserStore{
+		passwords: make(map[string]string),
+		hashes:    make(map[string]string),
+		uuids:     make(map[UUID]string),
+	}
+}
+
+// Add adds or replaces a user.
+func (s *UserStore) Add(name, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old, ok := s.passwords[name]; ok {
+		delete(s.hashes, string(hexSha224([]byte(old))))
+	}
+	s.passwords[name] = password
+	s.hashes[string(hexSha224([]byte(password)))] = name
+}
+
+// AddUUID grants a user access to UUID based protocols such as VLESS.
+func (s *UserStore) AddUUID(name string, id UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.uuids[id] = name
+}
+
+func (s *UserStore) Remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old, ok := s.passwords[name]; ok {
+		delete(s.hashes, string(hexSha224([]byte(old))))
+		delete(s.passwords, name)
+	}
+	for id, owner := range s.uuids {
+		if owner == name {
+			delete(s.uuids, id)
+		}
+	}
+}
+
+// Len returns the number of users with a password.
+func (s *UserStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.passwords)
+}
+
+// AuthUUID looks up the user owning id.
+func (s *UserStore) AuthUUID(id UUID) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name, ok := s.uuids[id]
+	return name, ok
+}
+
+// AuthTrojan looks up the user owning a hex(SHA224(password)) value.
+func (s *UserStore) AuthTrojan(hash []byte) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name, ok := s.hashes[string(hash)]
+	return name, ok
+}
+
+// Auth reports whether password is correct for the named user.
+func (s *UserStore) Auth(name, password string) bool {
+	s.mu.RLock()
+	want, ok := s.passwords[name]
+	s.mu.RUnlock()
+
+	return ok && subtle.ConstantTimeCompare([]byte(want), []byte(password)) == 1
+}
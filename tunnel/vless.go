@@ -0,0 +1,208 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+)
+
+/*
++---------+------+-----------+--------+-----+------+------+----------+
+| Version | UUID | AddonsLen | Addons | CMD | Port | ATYP | DST.ADDR |
++---------+------+-----------+--------+-----+------+------+----------+
+|    1    |  16  |     1     |   M    |  1  |  2   |  1   | Variable |
++---------+------+-----------+--------+-----+------+------+----------+
+
+the response header is Version and AddonsLen (0), followed by the payload.
+
+for the UDP command every packet in either direction is prefixed with its
+length in 2 bytes, and the destination is fixed by the request.
+*/
+
+const (
+	vlessVersion = 0
+
+	vlessCmdTCP = 1
+	vlessCmdUDP = 2
+	vlessCmdMux = 3
+
+	vlessAtypIPv4   = 1
+	vlessAtypDomain = 2
+	vlessAtypIPv6   = 3
+)
+
+var errVLESSVersion = errors.New("unsupported VLESS version")
+
+// HandleVLESS serves one VLESS session over conn, e.g. a TLS, WebSocket or
+// gRPC stream connection.
+func HandleVLESS(conn net.Conn) {
+
+	connData := getBuffer(smallBufferSize)
+	defer putBuffer(connData)
+
+	user, cmd, addr, err := readVLESSRequest(conn, connData.buf)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	switch cmd {
+	case vlessCmdTCP:
+		vlessTCPProcess(conn, addr)
+	case vlessCmdUDP:
+		vlessUDPProcess(conn, user, addr)
+	default:
+
+	}
+}
+
+// readVLESSRequest reads the request header, returns the authenticated user
+// and converts the destination to a SOCKS address. The returned Addr does not
+// alias buf.
+func readVLESSRequest(r io.Reader, buf []byte) (string, Command, Addr, error) {
+	header := buf[:1+16+1]
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", 0, nil, err
+	}
+
+	if header[0] != vlessVersion {
+		return "", 0, nil, errVLESSVersion
+	}
+
+	var id UUID
+	copy(id[:], header[1:17])
+	user, ok := Users.AuthUUID(id)
+	if !ok {
+		return "", 0, nil, ErrAuth
+	}
+
+	// Addons (flow control hints) are not used.
+	if _, err := io.ReadFull(r, buf[:header[17]]); err != nil {
+		return "", 0, nil, err
+	}
+
+	// CMD, Port, ATYP
+	if _, err := io.ReadFull(r, buf[:4]); err != nil {
+		return "", 0, nil, err
+	}
+	cmd, port, atyp := buf[0], [2]byte{buf[1], buf[2]}, buf[3]
+
+	var addr Addr
+	switch atyp {
+	case vlessAtypIPv4:
+		addr = make(Addr, 1+net.IPv4len+2)
+		addr[0] = AtypIPv4
+		if _, err := io.ReadFull(r, addr[1:1+net.IPv4len]); err != nil {
+			return "", 0, nil, err
+		}
+	case vlessAtypIPv6:
+		addr = make(Addr, 1+net.IPv6len+2)
+		addr[0] = AtypIPv6
+		if _, err := io.ReadFull(r, addr[1:1+net.IPv6len]); err != nil {
+			return "", 0, nil, err
+		}
+	case vlessAtypDomain:
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return "", 0, nil, err
+		}
+		addr = make(Addr, 1+1+int(buf[0])+2)
+		addr[0] = AtypDomainName
+		addr[1] = buf[0]
+		if _, err := io.ReadFull(r, addr[2:2+int(buf[0])]); err != nil {
+			return "", 0, nil, err
+		}
+	default:
+		return "", 0, nil, ErrAddressNotSupported
+	}
+	copy(addr[len(addr)-2:], port[:])
+
+	if cmd == vlessCmdMux {
+		return "", 0, nil, ErrCommandNotSupported
+	}
+
+	return user, cmd, addr, nil
+}
+
+func vlessTCPProcess(clientConn net.Conn, addr Addr) {
+
+	conn, err := DefaultEgress.Dial("tcp", addr)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := clientConn.Write([]byte{vlessVersion, 0}); err != nil {
+		return
+	}
+
+	relay(clientConn, conn)
+}
+
+func vlessUDPProcess(clientConn net.Conn, user string, addr Addr) {
+
+	if !DefaultEgress.AllowUDP(addr) {
+		return
+	}
+
+	session, err := DefaultEgress.listenUDPSession(user)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer session.Close()
+	// Replies carry no source address, they can only come from addr.
+	session.mode = PortRestrictedCone
+
+	if _, err := clientConn.Write([]byte{vlessVersion, 0}); err != nil {
+		return
+	}
+
+	// client <-- destination
+
+	go func() {
+		// Unblock the client reader once the relay is done.
+		defer clientConn.Close()
+
+		packet := getBuffer(largeBufferSize)
+		defer putBuffer(packet)
+
+		for {
+			n, _, err := session.ReadFrom(packet.buf[2:])
+			if err != nil {
+				return
+			}
+
+			binary.BigEndian.PutUint16(packet.buf, uint16(n))
+			if _, err := clientConn.Write(packet.buf[:2+n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	// client --> destination
+
+	connData := getBuffer(largeBufferSize)
+	defer putBuffer(connData)
+
+	for {
+		if _, err := io.ReadFull(clientConn, connData.buf[:2]); err != nil {
+			return
+		}
+
+		length := int(binary.BigEndian.Uint16(connData.buf))
+		if length > len(connData.buf) {
+			return
+		}
+
+		if _, err := io.ReadFull(clientConn, connData.buf[:length]); err != nil {
+			return
+		}
+
+		if err := session.WriteTo(connData.buf[:length], addr); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// vlessRequest returns a VLESS request header for target, which is an
+// IPv4, IPv6 or domain host and port.
+func vlessRequest(id UUID, addons []byte, cmd byte, target string) []byte {
+	host, portStr, _ := net.SplitHostPort(target)
+	port, _ := netip.ParseAddrPort("0.0.0.0:" + portStr)
+
+	b := []byte{vlessVersion}
+	b = append(b, id[:]...)
+	b = append(b, byte(len(addons)))
+	b = append(b, addons...)
+	b = append(b, cmd)
+	b = binary.BigEndian.AppendUint16(b, port.Port())
+
+	ip, err := netip.ParseAddr(host)
+	switch {
+	case err != nil:
+		b = append(b, vlessAtypDomain, byte(len(host)))
+		b = append(b, host...)
+	case ip.Is4():
+		b = append(b, vlessAtypIPv4)
+		b = append(b, ip.AsSlice()...)
+	default:
+		b = append(b, vlessAtypIPv6)
+		b = append(b, ip.AsSlice()...)
+	}
+	return b
+}
+
+func TestReadVLESSRequest(t *testing.T) {
+	unknown := UUID{1}
+
+	for _, tt := range []struct {
+		name    string
+		request []byte
+		cmd     Command
+		addr    string
+		err     error
+	}{
+		{"IPv4", vlessRequest(testUUID, nil, vlessCmdTCP, "1.2.3.4:80"), vlessCmdTCP, "1.2.3.4:80", nil},
+		{"IPv6", vlessRequest(testUUID, nil, vlessCmdTCP, "[2001:db8::1]:443"), vlessCmdTCP, "[2001:db8::1]:443", nil},
+		{"domain", vlessRequest(testUUID, nil, vlessCmdTCP, "example.com:8080"), vlessCmdTCP, "example.com:8080", nil},
+		{"UDP", vlessRequest(testUUID, nil, vlessCmdUDP, "8.8.8.8:53"), vlessCmdUDP, "8.8.8.8:53", nil},
+		// Addons are skipped whatever they hold.
+		{"addons", vlessRequest(testUUID, []byte{0x0a, 0x03, 'x', 'y', 'z'}, vlessCmdTCP, "example.com:80"), vlessCmdTCP, "example.com:80", nil},
+		{"mux", vlessRequest(testUUID, nil, vlessCmdMux, "v1.mux.cool:0"), 0, "", ErrCommandNotSupported},
+		{"unknown UUID", vlessRequest(unknown, nil, vlessCmdTCP, "example.com:80"), 0, "", ErrAuth},
+		{"version", append([]byte{1}, vlessRequest(testUUID, nil, vlessCmdTCP, "example.com:80")[1:]...), 0, "", errVLESSVersion},
+		{"address type", append(vlessRequest(testUUID, nil, vlessCmdTCP, "1.2.3.4:80")[:1+16+1+1+2], 9), 0, "", ErrAddressNotSupported},
+		{"truncated", vlessRequest(testUUID, nil, vlessCmdTCP, "example.com:80")[:25], 0, "", io.ErrUnexpectedEOF},
+	} {
+		// Trailing payload is left unread.
+		r := bytes.NewReader(append(tt.request, "payload"...))
+
+		user, cmd, addr, err := readVLESSRequest(r, make([]byte, smallBufferSize))
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if user != "test" || cmd != tt.cmd || addr.String() != tt.addr {
+			t.Errorf("%s: user %q, command %d, address %s", tt.name, user, cmd, addr)
+		}
+		if r.Len() != len("payload") {
+			t.Errorf("%s: left %d bytes unread", tt.name, r.Len())
+		}
+	}
+}
+
+// startVLESS runs HandleVLESS on one end of a connection and returns the other.
+func startVLESS(t *testing.T) net.Conn {
+	client, server := tcpPair(t)
+	go func() {
+		defer server.Close()
+		HandleVLESS(server)
+	}()
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client
+}
+
+func TestVLESSTCP(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	conn := startVLESS(t)
+	if _, err := conn.Write(append(vlessRequest(testUUID, nil, vlessCmdTCP, echo.Addr().String()), "hello"...)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The response header comes first, then the payload.
+	got := make([]byte, 2+len("hello"))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "\x00\x00hello" {
+		t.Fatalf("response %q", got)
+	}
+}
+
+func TestVLESSUDP(t *testing.T) {
+	echo := udpEchoServer(t)
+	defer echo.Close()
+
+	conn := startVLESS(t)
+	request := vlessRequest(testUUID, nil, vlessCmdUDP, echo.LocalAddr().String())
+	request = binary.BigEndian.AppendUint16(request, 4)
+	if _, err := conn.Write(append(request, "ping"...)); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, 2+2+len("ping"))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "\x00\x00\x00\x04ping" {
+		t.Fatalf("response %q", got)
+	}
+}
+
+func TestVLESSUDPOtherSource(t *testing.T) {
+	dest := udpPeer(t, net.IPv4(127, 0, 0, 1))
+	other := udpPeer(t, net.IPv4(127, 0, 0, 1))
+
+	conn := startVLESS(t)
+	request := vlessRequest(testUUID, nil, vlessCmdUDP, dest.LocalAddr().String())
+	request = binary.BigEndian.AppendUint16(request, 4)
+	if _, err := conn.Write(append(request, "ping"...)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, largeBufferSize)
+	dest.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, relay, err := dest.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the destination may reply, the other packet would come first.
+	other.WriteTo([]byte("spam"), relay)
+	dest.WriteTo([]byte("pong"), relay)
+
+	got := make([]byte, 2+2+len("pong"))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "\x00\x00\x00\x04pong" {
+		t.Fatalf("response %q", got)
+	}
+}
+
+func TestVLESSUnknownUUID(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	conn := startVLESS(t)
+	if _, err := conn.Write(vlessRequest(UUID{1}, nil, vlessCmdTCP, echo.Addr().String())); err != nil {
+		t.Fatal(err)
+	}
+
+	// No response header, the connection is just closed, reset if the
+	// rest of the request was left unread.
+	if got, _ := io.ReadAll(conn); len(got) != 0 {
+		t.Fatalf("read %q", got)
+	}
+}
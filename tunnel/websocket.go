@@ -0,0 +1,188 @@
+package tunnel
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// DefaultMaxEarlyData is the early-data limit common clients are configured
+// with, a sensible value for WithMaxEarlyData.
+const DefaultMaxEarlyData = 2048
+
+type WebSocketOptions struct {
+	Handler      func(net.Conn)
+	CheckOrigin  func(r *http.Request) bool
+	MaxEarlyData int
+}
+
+type WebSocketOption func(*WebSocketOptions)
+
+// WithWebSocketHandler sets the session handler, HandleTrojan by default.
+func WithWebSocketHandler(handler func(net.Conn)) WebSocketOption {
+	return func(o *WebSocketOptions) {
+		o.Handler = handler
+	}
+}
+
+// WithCheckOrigin sets the origin check. All origins are accepted by default.
+func WithCheckOrigin(fn func(r *http.Request) bool) WebSocketOption {
+	return func(o *WebSocketOptions) {
+		o.CheckOrigin = fn
+	}
+}
+
+// WithMaxEarlyData accepts up to n bytes of early data, base64url encoded in
+// Sec-WebSocket-Protocol, as the start of the session. Once enabled, the
+// header carries nothing else: any value that decodes is early data. Early
+// data is disabled by default.
+func WithMaxEarlyData(n int) WebSocketOption {
+	return func(o *WebSocketOptions) {
+		o.MaxEarlyData = n
+	}
+}
+
+// WebSocket returns a gin middleware that upgrades requests for path to
+// WebSocket and runs a Trojan session over binary frames. Other requests
+// are passed to the next handler.
+func WebSocket(path string, options ...WebSocketOption) gin.HandlerFunc {
+	o := &WebSocketOptions{
+		Handler:     HandleTrojan,
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	for _, setter := range options {
+		setter(o)
+	}
+
+	upgrader := &websocket.Upgrader{
+		ReadBufferSize:  mediumBufferSize,
+		WriteBufferSize: mediumBufferSize,
+		WriteBufferPool: &sync.Pool{},
+		CheckOrigin:     o.CheckOrigin,
+	}
+
+	return func(c *gin.Context) {
+		if c.Request.URL.Path != path || !websocket.IsWebSocketUpgrade(c.Request) {
+			c.Next()
+			return
+		}
+
+		var responseHeader http.Header
+		earlyData, ok := decodeEarlyData(c.Request.Header.Get("Sec-WebSocket-Protocol"), o.MaxEarlyData)
+		if !ok {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if len(earlyData) > 0 {
+			// Clients expect the protocol they sent to be echoed back.
+			responseHeader = http.Header{"Sec-Websocket-Protocol": {c.Request.Header.Get("Sec-WebSocket-Protocol")}}
+		}
+
+		ws, err := upgrader.Upgrade(c.Writer, c.Request, responseHeader)
+		if err != nil {
+			c.Abort()
+			return
+		}
+		c.Abort()
+
+		conn := newWSConn(ws, earlyData)
+		defer conn.Close()
+
+		o.Handler(conn)
+	}
+}
+
+func decodeEarlyData(protocol string, max int) ([]byte, bool) {
+	if protocol == "" || max <= 0 {
+		return nil, true
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(protocol, "="))
+	if err != nil {
+		// Not early data, an ordinary subprotocol.
+		return nil, true
+	}
+	if len(data) > max {
+		return nil, false
+	}
+	return data, true
+}
+
+// wsConn adapts a WebSocket connection to net.Conn. Binary messages are
+// concatenated into a byte stream.
+type wsConn struct {
+	*websocket.Conn
+	reader io.Reader
+	early  []byte
+
+	writeMu sync.Mutex
+}
+
+func newWSConn(ws *websocket.Conn, early []byte) *wsConn {
+	return &wsConn{Conn: ws, early: early}
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	if len(c.early) > 0 {
+		n := copy(b, c.early)
+		c.early = c.early[n:]
+		return n, nil
+	}
+
+	for {
+		if c.reader == nil {
+			msgType, r, err := c.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if msgType != websocket.BinaryMessage {
+				continue
+			}
+			c.reader = r
+		}
+
+		n, err := c.reader.Read(b)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *wsConn) Close() error {
+	c.writeMu.Lock()
+	c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	c.writeMu.Unlock()
+	return c.Conn.Close()
+}
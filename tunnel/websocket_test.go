@@ -0,0 +1,161 @@
+package tunnel
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// startWebSocket serves the WebSocket transport on /ws in front of a handler
+// answering "next".
+func startWebSocket(t *testing.T, options ...WebSocketOption) string {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(WebSocket("/ws", options...))
+	router.NoRoute(func(c *gin.Context) {
+		c.String(http.StatusOK, "next")
+	})
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func dialWebSocket(t *testing.T, addr, protocol string) (*websocket.Conn, *http.Response) {
+	header := http.Header{}
+	if protocol != "" {
+		header.Set("Sec-WebSocket-Protocol", protocol)
+	}
+	ws, resp, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws, resp
+}
+
+// readMessages reads binary messages from ws until it has n bytes.
+func readMessages(t *testing.T, ws *websocket.Conn, n int) string {
+	var got []byte
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(got) < n {
+		msgType, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msgType != websocket.BinaryMessage {
+			t.Fatalf("message type %d", msgType)
+		}
+		got = append(got, data...)
+	}
+	return string(got)
+}
+
+func TestWebSocketTrojan(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	addr := startWebSocket(t)
+
+	ws, _ := dialWebSocket(t, addr, "")
+
+	// The request may be split across frames; the payload follows in its own.
+	request := trojanConnect(testPassword, echo.Addr().String())
+	for _, frame := range [][]byte{request[:10], request[10:], []byte("hello")} {
+		if err := ws.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readMessages(t, ws, len("hello")); got != "hello" {
+		t.Fatalf("echo = %q", got)
+	}
+}
+
+func TestWebSocketPassthrough(t *testing.T) {
+	addr := startWebSocket(t)
+
+	for _, path := range []string{"/ws", "/other"} {
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "next" {
+			t.Errorf("%s: got %q", path, body)
+		}
+	}
+}
+
+func TestWebSocketEarlyData(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	addr := startWebSocket(t, WithMaxEarlyData(DefaultMaxEarlyData))
+
+	// The whole request and the first payload ride in the handshake.
+	early := append(trojanConnect(testPassword, echo.Addr().String()), "hello"...)
+	protocol := base64.RawURLEncoding.EncodeToString(early)
+
+	ws, resp := dialWebSocket(t, addr, protocol)
+	if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != protocol {
+		t.Fatalf("Sec-WebSocket-Protocol = %q", got)
+	}
+	if got := readMessages(t, ws, len("hello")); got != "hello" {
+		t.Fatalf("echo = %q", got)
+	}
+
+	// Early data past the limit is refused.
+	header := http.Header{"Sec-WebSocket-Protocol": {base64.RawURLEncoding.EncodeToString(make([]byte, DefaultMaxEarlyData+1))}}
+	_, resp, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", header)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("oversized early data: %v", err)
+	}
+}
+
+func TestWebSocketSubprotocol(t *testing.T) {
+	first := make(chan string, 1)
+	addr := startWebSocket(t, WithWebSocketHandler(func(conn net.Conn) {
+		buf := make([]byte, 16)
+		n, _ := conn.Read(buf)
+		first <- string(buf[:n])
+	}))
+
+	// "chat" is valid base64url, but without early data enabled it is an
+	// ordinary subprotocol and never reaches the handler.
+	ws, _ := dialWebSocket(t, addr, "chat")
+	if err := ws.WriteMessage(websocket.BinaryMessage, []byte("frame")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-first; got != "frame" {
+		t.Fatalf("handler read %q", got)
+	}
+}
+
+func TestDecodeEarlyData(t *testing.T) {
+	for _, tt := range []struct {
+		protocol string
+		max      int
+		data     string
+		ok       bool
+	}{
+		{"", 16, "", true},
+		{"aGVsbG8", 0, "", true},
+		{"aGVsbG8", 16, "hello", true},
+		{"aGVsbG8=", 16, "hello", true},
+		{"aGVsbG8", 4, "", false},
+		// Not base64url, an ordinary subprotocol.
+		{"v1.chat", 16, "", true},
+	} {
+		data, ok := decodeEarlyData(tt.protocol, tt.max)
+		if string(data) != tt.data || ok != tt.ok {
+			t.Errorf("decodeEarlyData(%q, %d) = %q, %v", tt.protocol, tt.max, data, ok)
+		}
+	}
+}